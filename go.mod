@@ -3,16 +3,18 @@ module cr
 go 1.23.5
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/GoToUse/treeprint v0.0.0-20230314143140-b9b91db455f6
 	github.com/gomarkdown/markdown v0.0.0-20250311123330-531bef5e742b
+	github.com/mattn/go-isatty v0.0.20
+	golang.org/x/term v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
 
 require (
@@ -0,0 +1,236 @@
+package mdrun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	// Defaults of the flags for programs using Parse and Run without Main
+	options.listBaseLevel, options.runBaseLevel = 1, 2
+	options.timeout = defaultTimeout
+	options.retryDelay = time.Second
+	options.color = "auto"
+}
+
+// CmdNode is a heading of a parsed markdown document with its code blocks,
+// env table and sub headings
+type CmdNode struct {
+	Heading     string
+	Level       int
+	Description string
+	Env         map[string]string
+	Hidden      bool
+	CodeBlocks  []CodeBlock
+	Children    []CmdNode
+
+	node *cmdNode  // The node in the tree of doc
+	doc  []cmdNode // Top level commands of the document, resolving dependencies
+}
+
+// CodeBlock is a code block with the settings parsed from its info string
+type CodeBlock struct {
+	Lang      string
+	Flags     []string
+	Attrs     map[string]string
+	Code      string
+	File      string // Empty for a document given to Parse
+	StartLine int
+}
+
+// exportNodes builds the exported form of nodes, which are part of the tree
+// of doc
+func exportNodes(nodes []cmdNode, doc []cmdNode) []CmdNode {
+	exported := make([]CmdNode, len(nodes))
+	for i := range nodes {
+		node := &nodes[i]
+		exported[i] = CmdNode{
+			Heading:     getHeadingText(node.Heading),
+			Level:       node.Heading.Level,
+			Description: node.Description,
+			Env:         node.Env,
+			Hidden:      node.Hidden,
+			Children:    exportNodes(node.Children, doc),
+			node:        node,
+			doc:         doc,
+		}
+		for _, block := range node.CodeBlocks {
+			exported[i].CodeBlocks = append(exported[i].CodeBlocks, CodeBlock{
+				Lang:      block.Lang,
+				Flags:     block.Flags,
+				Attrs:     block.Attrs,
+				Code:      string(block.Literal),
+				File:      block.File,
+				StartLine: block.StartLine,
+			})
+		}
+	}
+	return exported
+}
+
+// RunOptions configures Run
+type RunOptions struct {
+	Args        []string          // Arguments passed to each code block
+	HeadingPath []string          // Set as MD_HEADING_PATH, the lower cased heading by default
+	Env         map[string]string // Env of every code block, overridden by env tables
+
+	// Streams of the code blocks, the os streams when nil. The output is
+	// also captured in the Result.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Result is the captured outcome of Run
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Parse builds the command tree of a markdown document. Each tree is
+// independent, the dependencies of its nodes are resolved within it.
+func Parse(source []byte) ([]CmdNode, error) {
+	docProblems = nil
+	cmdNodes, err := parseSource(source, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAliases(cmdNodes); err != nil {
+		return nil, err
+	}
+	return exportNodes(cmdNodes, cmdNodes), nil
+}
+
+// Find returns the node of the command tree matching path, e.g. "test", "env"
+func Find(cmdNodes []CmdNode, path ...string) (CmdNode, bool) {
+	nodes := make([]cmdNode, len(cmdNodes))
+	for i, node := range cmdNodes {
+		if node.node == nil {
+			return CmdNode{}, false
+		}
+		nodes[i] = *node.node
+	}
+	return findNode(cmdNodes, joinHeadingWords(nodes, path), 0)
+}
+
+// findNode returns the node matching path, matched like findCmdNode
+func findNode(cmdNodes []CmdNode, path []string, currentDepth int) (CmdNode, bool) {
+	if currentDepth >= len(path) {
+		return CmdNode{}, false
+	}
+
+	for _, node := range cmdNodes {
+		if node.Level < options.runBaseLevel {
+			if found, ok := findNode(node.Children, path, currentDepth); ok {
+				return found, true
+			}
+			continue
+		}
+
+		if matchHeading(*node.node, path[currentDepth]) {
+			if currentDepth == len(path)-1 {
+				return node, true
+			}
+			if found, ok := findNode(node.Children, path, currentDepth+1); ok {
+				return found, true
+			}
+		}
+	}
+	return CmdNode{}, false
+}
+
+// Run runs the code blocks of node and captures their output. Exports and
+// dependencies are tracked per call. Run is not safe for concurrent use.
+func Run(node CmdNode, opts RunOptions) (Result, error) {
+	if node.node == nil {
+		return Result{}, errors.New("node is not from Parse or Runner.Load")
+	}
+	var stdout, stderr bytes.Buffer
+	var stdin io.Reader = os.Stdin
+	var outStream, errStream io.Writer = os.Stdout, os.Stderr
+	if opts.Stdin != nil {
+		stdin = opts.Stdin
+	}
+	if opts.Stdout != nil {
+		outStream = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		errStream = opts.Stderr
+	}
+	// The caller may pass one writer as both streams
+	var streamLock sync.Mutex
+	codeStdin = stdin
+	codeStdout = io.MultiWriter(&stdout, syncWriter{&streamLock, outStream})
+	codeStderr = io.MultiWriter(&stderr, syncWriter{&streamLock, errStream})
+	baseEnv, rootNodes = opts.Env, node.doc
+	defer func() {
+		codeStdin, codeStdout, codeStderr = os.Stdin, os.Stdout, os.Stderr
+		baseEnv, rootNodes = nil, nil
+	}()
+	resetRunState()
+
+	headingPath := opts.HeadingPath
+	if headingPath == nil {
+		headingPath = []string{strings.ToLower(node.Heading)}
+	}
+	err := execCmdNode(*node.node, headingPath, opts.Args)
+
+	result := Result{Stdout: stdout.String(), Stderr: stderr.String()}
+	if err != nil {
+		result.ExitCode = exitCode(err)
+	}
+	return result, err
+}
+
+// Runner runs the commands of markdown files with its own settings
+type Runner struct {
+	Files   []string          // Markdown files or URLs, merged like repeated --file
+	Env     map[string]string // Env of every code block, overridden by env tables
+	Timeout time.Duration     // Timeout for fetching remote files, 30s by default
+}
+
+// Load parses the files of the runner into a command tree
+func (r Runner) Load() ([]CmdNode, error) {
+	cmdNodes, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return exportNodes(cmdNodes, cmdNodes), nil
+}
+
+func (r Runner) load() ([]cmdNode, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return loadDoc(r.Files, timeout)
+}
+
+// Run loads the files and runs the command matching path. The env of opts
+// overrides the env of the runner.
+func (r Runner) Run(path []string, opts RunOptions) (Result, error) {
+	cmdNodes, err := r.load()
+	if err != nil {
+		return Result{}, err
+	}
+	node, found := Find(exportNodes(cmdNodes, cmdNodes), path...)
+	if !found {
+		return Result{}, notFoundError(cmdNodes, path)
+	}
+
+	env := make(map[string]string)
+	for key, value := range r.Env {
+		env[key] = value
+	}
+	for key, value := range opts.Env {
+		env[key] = value
+	}
+	opts.Env = env
+	return Run(node, opts)
+}
@@ -0,0 +1,93 @@
+package mdrun
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const apiTestDoc = "# doc\n\n## echo\n\n```sh\necho out \"$@\"\necho err >&2\n```\n"
+
+func TestRunCapturesOutput(t *testing.T) {
+	cmdNodes, err := Parse([]byte(apiTestDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, found := Find(cmdNodes, "echo")
+	if !found {
+		t.Fatal("command echo not found")
+	}
+
+	var stdout, stderr bytes.Buffer
+	result, err := Run(node, RunOptions{Args: []string{"a"}, Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "out a\n" {
+		t.Errorf("stdout = %q, want %q", got, "out a\n")
+	}
+	if got := stderr.String(); got != "err\n" {
+		t.Errorf("stderr = %q, want %q", got, "err\n")
+	}
+	if result.Stdout != stdout.String() || result.Stderr != stderr.String() || result.ExitCode != 0 {
+		t.Errorf("result = %+v, does not match the streams", result)
+	}
+}
+
+func TestRunSharedWriter(t *testing.T) {
+	cmdNodes, err := Parse([]byte(apiTestDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _ := Find(cmdNodes, "echo")
+
+	var output bytes.Buffer
+	if _, err := Run(node, RunOptions{Stdout: &output, Stderr: &output}); err != nil {
+		t.Fatal(err)
+	}
+	if got := output.String(); !strings.Contains(got, "out\n") || !strings.Contains(got, "err\n") {
+		t.Errorf("output = %q, want both streams", got)
+	}
+}
+
+func TestRunRequiredEnv(t *testing.T) {
+	doc := "# doc\n\n## req\n\n| key  | value |\n| ---- | ----- |\n| NEED | ?     |\n\n```sh\necho \"$NEED\"\n```\n"
+	cmdNodes, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _ := Find(cmdNodes, "req")
+
+	var stdout bytes.Buffer
+	result, err := Run(node, RunOptions{Env: map[string]string{"NEED": "lib"}, Stdout: &stdout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "lib\n" {
+		t.Errorf("stdout = %q, want %q", result.Stdout, "lib\n")
+	}
+}
+
+func TestParseTreesAreIndependent(t *testing.T) {
+	doc := func(name string) []byte {
+		return []byte("# " + name + "\n\n## build\n\n```sh\necho " + name + "-build\n```\n\n" +
+			"## deploy\n\n| key     | value |\n| ------- | ----- |\n| depends | build |\n\n```sh\necho " + name + "-deploy\n```\n")
+	}
+	a, err := Parse(doc("A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(doc("B")); err != nil {
+		t.Fatal(err)
+	}
+
+	node, _ := Find(a, "deploy")
+	var stdout bytes.Buffer
+	result, err := Run(node, RunOptions{Stdout: &stdout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "A-build\nA-deploy\n"; result.Stdout != want {
+		t.Errorf("stdout = %q, want %q", result.Stdout, want)
+	}
+}
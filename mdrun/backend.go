@@ -0,0 +1,230 @@
+package mdrun
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// backend builds the command running cmdName with args in dir, env holds the
+// variables set for the code block on top of the inherited environment
+type backend func(cmdName string, args []string, env map[string]string, dir string) (*exec.Cmd, error)
+
+// localBackend runs commands on the host
+func localBackend(cmdName string, args []string, env map[string]string, dir string) (*exec.Cmd, error) {
+	cmd := exec.Command(cmdName, args...)
+	cmd.Env = hostEnv()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Dir = dir
+	return cmd, nil
+}
+
+// hostEnv returns the environment inherited by code blocks. With --clean-env
+// only the MD_ variables and those of --env-passthrough are kept.
+func hostEnv() []string {
+	if !options.cleanEnv {
+		return os.Environ()
+	}
+	var passthrough []string
+	for _, keys := range options.passEnv {
+		for _, key := range strings.Split(keys, ",") {
+			passthrough = append(passthrough, strings.TrimSpace(key))
+		}
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, "MD_") || slices.Contains(passthrough, key) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// dockerBackend runs commands in a new container of image with the working
+// directory and the export file mounted. Only the variables set for the code
+// block are passed, the host environment stays outside.
+func dockerBackend(image string) backend {
+	return func(cmdName string, args []string, env map[string]string, dir string) (*exec.Cmd, error) {
+		if dir == "" {
+			dir = "."
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		dockerArgs := []string{"run", "--rm", "-i", "-v", dir + ":" + dir, "-w", dir}
+		if export, exists := env["MD_EXPORT"]; exists {
+			dockerArgs = append(dockerArgs, "-v", export+":"+export)
+		}
+		for key, value := range env {
+			dockerArgs = append(dockerArgs, "-e", key+"="+value)
+		}
+		dockerArgs = append(dockerArgs, image, cmdName)
+		return exec.Command("docker", append(dockerArgs, args...)...), nil
+	}
+}
+
+// Variables of the host environment kept in the sandbox
+var sandboxEnvKeys = []string{"PATH", "LANG", "LC_ALL", "TERM", "TZ", "MD_EXE"}
+
+// sandboxBackend runs commands without network access in new user and network
+// namespaces created by unshare, with a clean environment and home as HOME
+// and TMPDIR. It refuses to run where the sandbox can not be set up.
+func sandboxBackend(home string) backend {
+	return func(cmdName string, args []string, env map[string]string, dir string) (*exec.Cmd, error) {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("--sandbox is not supported on %s", runtime.GOOS)
+		}
+		unshare, err := exec.LookPath("unshare")
+		if err != nil {
+			return nil, fmt.Errorf("--sandbox needs unshare: %w", err)
+		}
+
+		unshareArgs := []string{"--user", "--map-root-user", "--net", "--", cmdName}
+		cmd := exec.Command(unshare, append(unshareArgs, args...)...)
+		for _, key := range sandboxEnvKeys {
+			if value, exists := os.LookupEnv(key); exists {
+				cmd.Env = append(cmd.Env, key+"="+value)
+			}
+		}
+		cmd.Env = append(cmd.Env, "HOME="+home, "TMPDIR="+home)
+		for key, value := range env {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+		cmd.Dir = dir
+		return cmd, nil
+	}
+}
+
+var (
+	runningMu       sync.Mutex
+	runningCmds     = make(map[*exec.Cmd]bool) // The code blocks running, signals are forwarded to them
+	forwardedSignal os.Signal                  // The signal received, forwarded to runningCmds
+	interrupted     = make(chan struct{})      // Closed when a signal is received
+)
+
+// runForwarded runs cmd, receiving the signals forwarded by forwardSignals.
+// When cmd exits after a forwarded signal, it returns an interruptedError.
+// In a --parallel section execMu is released while cmd runs.
+func runForwarded(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	runningMu.Lock()
+	runningCmds[cmd] = true
+	runningMu.Unlock()
+
+	if inParallel {
+		execMu.Unlock()
+	}
+	err := cmd.Wait()
+	if inParallel {
+		execMu.Lock()
+	}
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	delete(runningCmds, cmd)
+	if forwardedSignal != nil {
+		return interruptedError{forwardedSignal}
+	}
+	return err
+}
+
+// interruptedError is the error of a code block stopped by a forwarded
+// signal. No further code blocks run, so their temp files are cleaned up, and
+// mdrun exits as killed by the signal.
+type interruptedError struct {
+	sig os.Signal
+}
+
+func (e interruptedError) Error() string {
+	return fmt.Sprintf("interrupted by %v", e.sig)
+}
+
+// checkInterrupted returns an interruptedError once a signal was received
+func checkInterrupted() error {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if forwardedSignal != nil {
+		return interruptedError{forwardedSignal}
+	}
+	return nil
+}
+
+// sleep waits for d, it returns an interruptedError when a signal is received
+// meanwhile
+func sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-interrupted:
+		return checkInterrupted()
+	}
+}
+
+// keepGoing reports whether to continue after err, with --keep-going unless
+// err is an interruption
+func keepGoing(err error) bool {
+	var interrupted interruptedError
+	return options.keepGoing && !errors.As(err, &interrupted)
+}
+
+// signalExitCode returns the exit code of a process killed by sig
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// forwardSignals forwards SIGINT and SIGTERM to the running code block, which
+// is then waited for by runForwarded. Without a running code block the signal
+// is recorded, so no further code blocks run and deferred cleanup happens on
+// the way out. A second signal then exits at once, unless --watch which stops
+// by itself.
+func forwardSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			runningMu.Lock()
+			first := forwardedSignal == nil
+			if first {
+				close(interrupted)
+			}
+			forwardedSignal = sig
+			if len(runningCmds) == 0 {
+				runningMu.Unlock()
+				if !first && !options.watch {
+					os.Exit(signalExitCode(sig))
+				}
+				continue
+			}
+
+			// Ctrl-C on a terminal already reached a code block sharing our group
+			if !(sig == os.Interrupt && isatty.IsTerminal(os.Stdin.Fd())) {
+				for cmd := range runningCmds {
+					if err := signalProcess(cmd, sig); err != nil && options.verbose > 0 {
+						errorMsg("warning: forwarding %v: %v", sig, err)
+					}
+				}
+			}
+			runningMu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package mdrun
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// Version of the cache format, bump it when cacheNode or parseDoc change
+const cacheVersion = 5
+
+// cacheCodeBlock is the cached form of a codeBlock
+type cacheCodeBlock struct {
+	Info      string            `json:"info"`
+	Code      string            `json:"code"`
+	Lang      string            `json:"lang"`
+	Flags     []string          `json:"flags,omitempty"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+	StartLine int               `json:"startLine"`
+	EndLine   int               `json:"endLine"`
+}
+
+// cacheNode is the cached form of a cmdNode
+type cacheNode struct {
+	Heading     string            `json:"heading"`
+	Level       int               `json:"level"`
+	Description string            `json:"description,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Hidden      bool              `json:"hidden,omitempty"`
+	CodeBlocks  []cacheCodeBlock  `json:"codeBlocks,omitempty"`
+	Children    []cacheNode       `json:"children,omitempty"`
+}
+
+// cacheFile is the content of a cache file, the command tree of a markdown
+// file and what it was parsed from
+type cacheFile struct {
+	Key   string      `json:"key"`
+	Nodes []cacheNode `json:"nodes"`
+}
+
+// cachePath returns the cache file of a markdown file and the key telling
+// whether the cache is valid: the file's path, modification time and size and
+// the settings parseDoc depends on
+func cachePath(file string) (string, string, error) {
+	// --check and the warnings of --verbose need parseDoc to run for the
+	// problems it finds
+	if options.noCache || options.check || options.verbose > 0 || file == "" || isRemote(file) {
+		return "", "", errors.New("not cached")
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", "", err
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", "", err
+	}
+
+	langs := make([]string, 0, len(languageConfigs))
+	for lang := range languageConfigs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	key := fmt.Sprintf("%d\x00%s\x00%d\x00%d\x00%s\x00%s", cacheVersion, abs, info.ModTime().UnixNano(), info.Size(), options.indented, strings.Join(langs, ","))
+	name := fmt.Sprintf("%x.json", sha256.Sum256([]byte(abs)))
+	return filepath.Join(dir, "mdrun", name), key, nil
+}
+
+// loadCache returns the cached command tree of file, it reports false when
+// there is no valid cache
+func loadCache(file string) ([]cmdNode, bool) {
+	path, key, err := cachePath(file)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var cache cacheFile
+	if err := json.Unmarshal(data, &cache); err != nil || cache.Key != key {
+		return nil, false
+	}
+
+	var fromCache func(nodes []cacheNode) []cmdNode
+	fromCache = func(nodes []cacheNode) []cmdNode {
+		var cmdNodes []cmdNode
+		for _, node := range nodes {
+			heading := ast.Heading{Level: node.Level}
+			heading.Children = []ast.Node{&ast.Text{Leaf: ast.Leaf{Literal: []byte(node.Heading)}}}
+			cmdNode := cmdNode{
+				Heading:     heading,
+				Env:         node.Env,
+				Description: node.Description,
+				Hidden:      node.Hidden,
+				Children:    fromCache(node.Children),
+			}
+			for _, block := range node.CodeBlocks {
+				codeBlock := codeBlock{Lang: block.Lang, Flags: block.Flags, Attrs: block.Attrs, File: file, StartLine: block.StartLine, EndLine: block.EndLine}
+				codeBlock.Info = []byte(block.Info)
+				codeBlock.Literal = []byte(block.Code)
+				cmdNode.CodeBlocks = append(cmdNode.CodeBlocks, codeBlock)
+			}
+			cmdNodes = append(cmdNodes, cmdNode)
+		}
+		return cmdNodes
+	}
+	cmdNodes := fromCache(cache.Nodes)
+	linkParents(cmdNodes, nil)
+	return cmdNodes, true
+}
+
+// saveCache stores the command tree of file, failures only cost speed and are
+// reported with --verbose
+func saveCache(file string, cmdNodes []cmdNode) {
+	path, key, err := cachePath(file)
+	if err != nil {
+		return
+	}
+
+	var toCache func(nodes []cmdNode) []cacheNode
+	toCache = func(nodes []cmdNode) []cacheNode {
+		var cacheNodes []cacheNode
+		for _, node := range nodes {
+			cacheNode := cacheNode{
+				Heading:     getHeadingText(node.Heading),
+				Level:       node.Heading.Level,
+				Description: node.Description,
+				Env:         node.Env,
+				Hidden:      node.Hidden,
+				Children:    toCache(node.Children),
+			}
+			for _, block := range node.CodeBlocks {
+				cacheNode.CodeBlocks = append(cacheNode.CodeBlocks, cacheCodeBlock{
+					Info:      string(block.Info),
+					Code:      string(block.Literal),
+					Lang:      block.Lang,
+					Flags:     block.Flags,
+					Attrs:     block.Attrs,
+					StartLine: block.StartLine,
+					EndLine:   block.EndLine,
+				})
+			}
+			cacheNodes = append(cacheNodes, cacheNode)
+		}
+		return cacheNodes
+	}
+
+	data, err := json.Marshal(cacheFile{Key: key, Nodes: toCache(cmdNodes)})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil && options.verbose > 0 {
+		errorMsg("warning: writing cache: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package mdrun
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Shell dialects understood by shellcheck
+var shellcheckDialects = map[string]string{
+	"sh": "sh", "shell": "sh", "bash": "bash", "dash": "dash", "ksh": "ksh", "ash": "busybox",
+}
+
+// checkDoc reports the problems found while parsing and headings which can
+// not be run because a sibling has the same heading
+func checkDoc(cmdNodes []cmdNode) error {
+	problems := append([]string{}, docProblems...)
+
+	var checkLevel func(nodes []cmdNode)
+	checkLevel = func(nodes []cmdNode) {
+		seen := make(map[string]bool)
+		for _, node := range levelNodes(nodes) {
+			heading := strings.ToLower(getHeadingText(node.Heading))
+			if seen[heading] {
+				problems = append(problems, fmt.Sprintf("duplicate heading '%s', only the first one can be run", getHeadingText(node.Heading)))
+			}
+			seen[heading] = true
+			checkLevel(node.Children)
+		}
+	}
+	checkLevel(cmdNodes)
+
+	_, duplicates := labeledBlocks(cmdNodes)
+	for _, id := range duplicates {
+		problems = append(problems, fmt.Sprintf("duplicate code block label '#%s', only the first one can be run", id))
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	return nil
+}
+
+// lintDoc checks all shell code blocks with shellcheck and reports the
+// findings per heading
+func lintDoc(cmdNodes []cmdNode) error {
+	shellcheck, err := exec.LookPath("shellcheck")
+	if err != nil {
+		return fmt.Errorf("shellcheck not found in PATH")
+	}
+
+	failed := 0
+	var walk func(nodes []cmdNode, path []string)
+	walk = func(nodes []cmdNode, path []string) {
+		for _, node := range nodes {
+			nodePath := path
+			if node.Heading.Level >= options.runBaseLevel {
+				nodePath = append(append([]string{}, path...), getHeadingText(node.Heading))
+			}
+			for _, codeBlock := range node.CodeBlocks {
+				dialect, exists := shellcheckDialects[codeBlock.Lang]
+				if !exists {
+					continue
+				}
+
+				cmd := exec.Command(shellcheck, "--shell", dialect, "-")
+				cmd.Stdin = bytes.NewReader(codeBlock.Literal)
+				output, err := cmd.CombinedOutput()
+				if err == nil {
+					continue
+				}
+				failed++
+				fmt.Printf("%s (%s:%d)\n", color.YellowString(strings.Join(nodePath, " > ")), codeBlock.File, codeBlock.StartLine)
+				fmt.Print(string(output))
+			}
+			walk(node.Children, nodePath)
+		}
+	}
+	walk(cmdNodes, nil)
+
+	if failed > 0 {
+		return fmt.Errorf("shellcheck reported problems in %d code blocks", failed)
+	}
+	return nil
+}
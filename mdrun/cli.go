@@ -0,0 +1,720 @@
+package mdrun
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+)
+
+// keyValueFlag is a repeatable KEY=VALUE flag
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	var pairs []string
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f keyValueFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", s)
+	}
+	f[key] = value
+	return nil
+}
+
+// stringsFlag is a repeatable string flag
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// countFlag is a boolean flag counting how often it is given, e.g. -v -v
+type countFlag int
+
+func (f *countFlag) String() string {
+	return strconv.Itoa(int(*f))
+}
+
+func (f *countFlag) Set(s string) error {
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		*f++
+	} else {
+		*f = 0
+	}
+	return nil
+}
+
+func (f *countFlag) IsBoolFlag() bool {
+	return true
+}
+
+// buildVersion returns the version set at build time, or the module version
+// recorded by go install
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
+// Content of the document written by --init
+const initTemplate = `# Tasks
+
+Commands of this project, run them with ` + "`{{program}} <heading...>`" + `, list them with ` + "`{{program}} --list`" + `.
+
+| key     | value |
+| ------- | ----- |
+| project | demo  |
+
+## build
+
+Build the project, the env table above is visible to all commands
+
+` + "```sh" + `
+echo "building ${project}"
+` + "```" + `
+
+## test
+
+Run the tests with the arguments given after --
+
+` + "```sh" + `
+echo "testing ${project} with arguments: $*"
+` + "```" + `
+
+### unit
+
+Run the unit tests as a sub heading, its env table overrides the parent
+
+| key   | value |
+| ----- | ----- |
+| scope | unit  |
+
+` + "```sh" + `
+echo "running ${scope} tests"
+` + "```" + `
+`
+
+// initDoc writes a starter document named {programName}.md to the current
+// directory, it fails if the file exists
+func initDoc() (string, error) {
+	file := programName + ".md"
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("%s already exists", file)
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.ReplaceAll(initTemplate, "{{program}}", programName)); err != nil {
+		return "", fmt.Errorf("writing %s: %w", file, err)
+	}
+	return file, nil
+}
+
+// commandArgs returns the arguments after the flags. The flag package drops
+// a "--" ending the flags, which is given back as it separates the heading
+// path from the args, e.g. "-v -- a" runs the default command with args a.
+func commandArgs() []string {
+	args := flag.Args()
+	if i := len(os.Args) - len(args) - 1; i > 0 && os.Args[i] == "--" {
+		return append([]string{"--"}, args...)
+	}
+	return args
+}
+
+func showHelp() {
+	const indention = "    "
+	var sb strings.Builder
+
+	sb.WriteString("Run markdown codeblocks by its heading.\n\n")
+	sb.WriteString(color.YellowString("USAGE:") + "\n")
+	sb.WriteString(fmt.Sprintf("%s%s [--file FILE]... <heading...> [-- <args...>]\n", indention, programName))
+	sb.WriteString(fmt.Sprintf("%s%s [--file FILE]... --sequence <heading>... [-- <args...>]\n", indention, programName))
+	sb.WriteString(fmt.Sprintf("%s%s [--file FILE]... <heading...> [-- <args...>] + <heading...> [-- <args...>]...\n", indention, programName))
+	sb.WriteString("\n")
+
+	sb.WriteString(color.YellowString("FLAGS:") + "\n")
+	sb.WriteString(fmt.Sprintf("%s-h, --help              Show this help\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-V, --version           Print the version, Go version and platform\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-v, --verbose           Print more information, -vv also lists env values and codeblocks\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-q, --quiet             Only print output of the executed commands and errors, wins over --time\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-l, --list              List commands instead of running the default command or picking one\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-i, --interactive       Pick the command to run, default on a terminal without a default command\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --long              List commands as lines of path, a tab and the description\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --json              Print commands as JSON\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --describe          Print path, languages, env keys and description of each heading as JSON\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --yaml              Print --describe as YAML\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --hooks             Run the sub headings pre and post before and after the codeblocks of a command\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-r, --recursive         Also run codeblocks of sub headings\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-n, --dry-run           Print the codeblocks that would run in order\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-p, --print             Print the codeblocks instead of running them\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --list-env          Print the env set for the codeblocks of the command instead of running them\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --init              Write a starter %s.md to the current directory\n", indention, programName))
+	sb.WriteString(fmt.Sprintf("%s    --check             Report unsupported codeblock languages, duplicate headings and bad env table rows\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --lint              Check shell codeblocks with shellcheck\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-y, --yes               Run codeblocks marked confirm without asking\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-k, --keep-going        Continue after failing codeblocks and report them at the end\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-s, --sequence          Run each HEADING as a top level command in order, ARGS go to each\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-w, --watch             Run again whenever the markdown file changes\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --respect-shebang   Run codeblocks starting with #! as executable scripts\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --allow-remote      Allow running codeblocks of a remote FILE\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --clean-env         Run codeblocks with only the env of the document and the MD_ variables\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --sandbox           Run codeblocks without network, host env and home, Linux only\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --output-prefix     Prefix each output line of codeblocks with their heading\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --time              Report the execution time of each command, with --verbose of each codeblock\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --no-cache          Always parse the markdown files instead of using the cached commands\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --no-pager          Do not show long verbose listings through $PAGER\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --no-color          Disable colored output, same as --color never\n", indention))
+	sb.WriteString("\n")
+
+	sb.WriteString(color.YellowString("OPTIONS:") + "\n")
+	sb.WriteString(fmt.Sprintf("%s-f, --file              MarkDown file or http(s) URL to use, repeatable\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --doc-name          File name to search for instead of %s.md, .%s.md and README.md, repeatable, or $MDRUN_DOC\n", indention, programName, programName))
+	sb.WriteString(fmt.Sprintf("%s    --root-marker       File or directory marking the project root to search FILE up to (default .git)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --config            Config file to use instead of the discovered ones\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --timeout           Timeout for fetching a remote FILE (default 30s)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --pre-hook          Heading path to run before the command, e.g. \"setup db\"\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --post-hook         Heading path to run after the command, also when it failed, with --watch\n", indention))
+	sb.WriteString(fmt.Sprintf("%s                        both run on each change\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --parallel          Run up to PARALLEL sub headings of the command at a time with --recursive, output lines are prefixed\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --retry             Re-run a codeblock exiting non-zero up to RETRY times (default 0)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --retry-delay       Delay before re-running a failing codeblock (default 1s)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s-b, --block             Only run the codeblock with name=BLOCK\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --arg               Value for {{NAME}} in placeholders codeblocks as NAME=VALUE\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --shell             Shell or command line for shell codeblocks, e.g. bash or \"bash -euo pipefail -c\"\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --only-language     Only run codeblocks of the language, e.g. sh, repeatable, also --lang\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --indented          Run indented codeblocks as the given language, e.g. sh\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --env-passthrough   Comma separated host env variables kept by --clean-env, e.g. PATH,HOME, repeatable\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --stdin             File to read stdin of codeblocks from, - for stdin\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --color             When to use colors: auto, always or never (default auto)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --grep              List only headings or descriptions containing PATTERN, ignoring case\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --grep-regexp       List only headings or descriptions matching the regular expression\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --depth             Levels of subcommands to list below each root (default unlimited)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --list-base-level   Heading level shown as tree roots (default 1)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --run-base-level    Heading level of top level commands (default 2)\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --junit             Write a junit XML report of executed commands\n", indention))
+	sb.WriteString(fmt.Sprintf("%s    --log-file          Append a JSON line per executed codeblock\n", indention))
+	sb.WriteString("\n")
+
+	fmt.Fprint(os.Stderr, sb.String())
+}
+
+// Name of the config file looked up beside the markdown file
+const configFileName = ".mdrun.toml"
+
+// languageOverride configures the interpreter of a language in a config file
+type languageOverride struct {
+	Command string   `toml:"command"`
+	Args    []string `toml:"args"`
+}
+
+// fileConfig is the content of a config file. The settings are defaults for
+// the command line flags of the same name.
+type fileConfig struct {
+	Shell     string                      `toml:"shell"`
+	Timeout   string                      `toml:"timeout"`
+	Color     string                      `toml:"color"`
+	Languages map[string]languageOverride `toml:"languages"`
+}
+
+// Set once Main parsed the command line
+var parsedFlags bool
+
+// isFlagSet reports whether the flag name was given on the command line
+func isFlagSet(name string) bool {
+	// The flags of a program using the library are not ours
+	if !parsedFlags {
+		return false
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// configFiles returns the config files to load in order, the global one and
+// the one beside the first local markdown file, or the one given by --config
+func configFiles(docFiles []string) []string {
+	if options.config != "" {
+		return []string{options.config}
+	}
+
+	var files []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, filepath.Join(dir, "mdrun", "config.toml"))
+	}
+	for _, file := range docFiles {
+		if !isRemote(file) {
+			files = append(files, filepath.Join(filepath.Dir(file), configFileName))
+			break
+		}
+	}
+	return files
+}
+
+// loadConfig applies the settings of the config files which are not given as
+// flags and merges their language overrides over languageConfigs, later files
+// take precedence. Discovered config files are optional, the one given by
+// --config must exist.
+func loadConfig(files []string) error {
+	for _, file := range files {
+		var cfg fileConfig
+		if _, err := toml.DecodeFile(file, &cfg); err != nil {
+			if errors.Is(err, fs.ErrNotExist) && options.config == "" {
+				continue
+			}
+			return fmt.Errorf("loading config: %w", err)
+		}
+
+		if cfg.Shell != "" && !isFlagSet("shell") {
+			options.shell = cfg.Shell
+		}
+		if cfg.Timeout != "" && !isFlagSet("timeout") {
+			timeout, err := time.ParseDuration(cfg.Timeout)
+			if err != nil {
+				return fmt.Errorf("loading config %s: invalid timeout: %w", file, err)
+			}
+			options.timeout = timeout
+		}
+		if cfg.Color != "" && !isFlagSet("color") && !isFlagSet("no-color") {
+			options.color = cfg.Color
+		}
+
+		for lang, override := range cfg.Languages {
+			config, exists := languageConfigs[lang]
+			if !exists && (override.Command == "" || len(override.Args) == 0) {
+				return fmt.Errorf("loading config %s: language '%s' needs a command and args", file, lang)
+			}
+			if override.Command != "" {
+				config.cmdName = override.Command
+			}
+			// Args describe how the code is passed, replacing a prepare step
+			if len(override.Args) > 0 {
+				config.prefixArgs = override.Args
+				config.prepare = nil
+			}
+			languageConfigs[lang] = config
+		}
+	}
+	return nil
+}
+
+const (
+	watchInterval = 500 * time.Millisecond // How often to check the file
+	watchDebounce = 200 * time.Millisecond // How long the file must be unchanged
+)
+
+// modTime returns the latest modification time of files
+func modTime(files []string) time.Time {
+	var latest time.Time
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// watchDoc runs path, then re-parses files and runs path again whenever one
+// of them changes, until interrupted
+func watchDoc(files []string, path []string, args []string) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	run := func() {
+		resetRunState()
+		cmdNodes, err := loadDoc(files, options.timeout)
+		if err != nil {
+			errorMsg("%v", err)
+			return
+		}
+		rootNodes = cmdNodes
+		err = runHook(cmdNodes, options.preHook)
+		if err == nil {
+			var found bool
+			found, err = findAndExecuteNestedCommand(cmdNodes, path, args, 0)
+			if !found {
+				err = notFoundError(cmdNodes, path)
+			}
+		}
+		if hookErr := runHook(cmdNodes, options.postHook); hookErr != nil {
+			err = errors.Join(err, hookErr)
+		}
+		if err != nil {
+			errorMsg("%v", err)
+		}
+		printTotalTime()
+	}
+
+	lastMod := modTime(files)
+	run()
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-interrupt:
+			return
+		case <-ticker.C:
+		}
+
+		mod := modTime(files)
+		if mod.Equal(lastMod) {
+			continue
+		}
+		// Debounce rapid saves by waiting until the file stops changing
+		for {
+			time.Sleep(watchDebounce)
+			next := modTime(files)
+			if next.Equal(mod) {
+				break
+			}
+			mod = next
+		}
+		lastMod = mod
+
+		infoMsg("%s changed, running '%s'", strings.Join(files, ", "), strings.Join(path, " "))
+		run()
+	}
+}
+
+// Main runs the command line program with the flags and arguments of os.Args
+func Main() {
+	flag.BoolVar(&options.help, "h", false, "show this help")
+	flag.BoolVar(&options.help, "help", false, "show this help")
+	flag.BoolVar(&options.version, "V", false, "print the version")
+	flag.BoolVar(&options.version, "version", false, "print the version")
+	flag.Var(&options.verbose, "v", "enable verbose mode, repeatable")
+	flag.Var(&options.verbose, "verbose", "enable verbose mode, repeatable")
+	flag.BoolFunc("vv", "more verbose mode", func(string) error {
+		options.verbose += 2
+		return nil
+	})
+	flag.BoolVar(&options.quiet, "q", false, "suppress decorations")
+	flag.BoolVar(&options.quiet, "quiet", false, "suppress decorations")
+	flag.BoolVar(&options.list, "l", false, "list commands")
+	flag.BoolVar(&options.list, "list", false, "list commands")
+	flag.BoolVar(&options.interactive, "i", false, "pick a command interactively")
+	flag.BoolVar(&options.interactive, "interactive", false, "pick a command interactively")
+	flag.BoolVar(&options.json, "json", false, "print commands as JSON")
+	flag.BoolVar(&options.long, "long", false, "list commands as path and description per line")
+	flag.BoolVar(&options.describe, "describe", false, "print metadata of the headings")
+	flag.BoolVar(&options.yaml, "yaml", false, "print --describe as YAML")
+	flag.BoolVar(&options.hooks, "hooks", false, "run pre and post sub headings around commands")
+	flag.StringVar(&options.preHook, "pre-hook", "", "heading to run before the command")
+	flag.StringVar(&options.postHook, "post-hook", "", "heading to run after the command")
+	flag.BoolVar(&options.recursive, "r", false, "also run sub headings")
+	flag.BoolVar(&options.recursive, "recursive", false, "also run sub headings")
+	flag.IntVar(&options.parallel, "parallel", 1, "sub headings to run at a time with --recursive")
+	flag.BoolVar(&options.dryRun, "n", false, "print what would run")
+	flag.BoolVar(&options.dryRun, "dry-run", false, "print what would run")
+	flag.BoolVar(&options.print, "p", false, "print codeblocks instead of running")
+	flag.BoolVar(&options.print, "print", false, "print codeblocks instead of running")
+	flag.BoolVar(&options.listEnv, "list-env", false, "print the env of a command instead of running")
+	flag.BoolVar(&options.check, "check", false, "check the document for problems")
+	flag.BoolVar(&options.init, "init", false, "write a starter document")
+	flag.BoolVar(&options.lint, "lint", false, "check shell codeblocks with shellcheck")
+	flag.BoolVar(&options.yes, "y", false, "assume yes for confirmations")
+	flag.BoolVar(&options.yes, "yes", false, "assume yes for confirmations")
+	flag.BoolVar(&options.keepGoing, "k", false, "continue after failing codeblocks")
+	flag.BoolVar(&options.keepGoing, "keep-going", false, "continue after failing codeblocks")
+	flag.BoolVar(&options.sequence, "s", false, "run each heading as a separate command")
+	flag.BoolVar(&options.sequence, "sequence", false, "run each heading as a separate command")
+	flag.BoolVar(&options.watch, "w", false, "re-run when the file changes")
+	flag.BoolVar(&options.watch, "watch", false, "re-run when the file changes")
+	flag.BoolVar(&options.shebang, "respect-shebang", false, "run codeblocks starting with #! as scripts")
+	flag.BoolVar(&options.allowRemote, "allow-remote", false, "allow running remote documents")
+	flag.BoolVar(&options.sandbox, "sandbox", false, "run codeblocks without network and host env")
+	flag.BoolVar(&options.cleanEnv, "clean-env", false, "run codeblocks without the host env")
+	flag.Var(&options.passEnv, "env-passthrough", "host env variables kept by --clean-env")
+	flag.IntVar(&options.retry, "retry", 0, "times to re-run failing codeblocks")
+	flag.DurationVar(&options.retryDelay, "retry-delay", time.Second, "delay before re-running a failing codeblock")
+	flag.DurationVar(&options.timeout, "timeout", defaultTimeout, "timeout for fetching remote documents")
+	flag.StringVar(&options.grep, "grep", "", "list only headings containing the pattern")
+	flag.StringVar(&options.grepRegexp, "grep-regexp", "", "list only headings matching the regular expression")
+	flag.IntVar(&options.depth, "depth", 0, "levels of subcommands to list")
+	flag.IntVar(&options.listBaseLevel, "list-base-level", 1, "heading level of listed tree roots")
+	flag.IntVar(&options.runBaseLevel, "run-base-level", 2, "heading level of top level commands")
+	flag.BoolVar(&options.outputPrefix, "output-prefix", false, "prefix output lines with the heading")
+	flag.BoolVar(&options.noCache, "no-cache", false, "always parse the markdown files")
+	flag.BoolVar(&options.noPager, "no-pager", false, "do not page verbose listings")
+	flag.BoolVar(&options.noColor, "no-color", false, "disable colored output")
+	flag.StringVar(&options.color, "color", "auto", "when to use colors")
+	flag.Var(&options.files, "f", "specify the input file")
+	flag.Var(&options.files, "file", "specify the input file")
+	flag.StringVar(&options.block, "b", "", "run only the named code block")
+	flag.StringVar(&options.block, "block", "", "run only the named code block")
+	options.vars = make(keyValueFlag)
+	flag.Var(options.vars, "arg", "value for a {{name}} placeholder")
+	flag.StringVar(&options.shell, "shell", "", "command line for shell codeblocks")
+	flag.StringVar(&options.stdin, "stdin", "", "file to use as stdin of codeblocks")
+	flag.StringVar(&options.junit, "junit", "", "write a junit XML report")
+	flag.StringVar(&options.logFile, "log-file", "", "append executed codeblocks to a JSON lines log")
+	flag.BoolVar(&options.time, "time", false, "report execution time per command")
+	flag.StringVar(&options.indented, "indented", "", "language of indented codeblocks")
+	flag.Var(&options.onlyLanguages, "only-language", "run only codeblocks of the language")
+	flag.Var(&options.onlyLanguages, "lang", "run only codeblocks of the language")
+	flag.Var(&options.docNames, "doc-name", "file name to search for instead of the defaults")
+	flag.StringVar(&options.rootMarker, "root-marker", ".git", "file or directory marking the project root")
+	flag.StringVar(&options.config, "config", "", "config file to use instead of the discovered ones")
+
+	// Customize help message
+	flag.Usage = func() {
+		showHelp()
+	}
+
+	flag.Parse()
+	parsedFlags = true
+
+	if options.quiet && options.verbose > 0 {
+		errorMsg("--quiet and --verbose cannot be used together")
+		os.Exit(2)
+	}
+
+	if options.version {
+		fmt.Printf("%s %s %s %s/%s\n", programName, buildVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return
+	}
+
+	listFilter, err := headingFilter()
+	if err != nil {
+		errorMsg("%v", err)
+		os.Exit(2)
+	}
+	if listFilter != nil || options.long {
+		options.list = true
+	}
+
+	if options.init {
+		file, err := initDoc()
+		if err != nil {
+			errorMsg("%v", err)
+			os.Exit(1)
+		}
+		infoMsg("created %s, run '%s --list' to see its commands", file, programName)
+		return
+	}
+
+	inputFiles := options.files
+	if len(inputFiles) == 0 {
+		inputFile, err := findDoc()
+		if err != nil {
+			errorMsg("finding document: %v", err)
+			os.Exit(1)
+		}
+		inputFiles = []string{inputFile}
+	}
+
+	if err := loadConfig(configFiles(inputFiles)); err != nil {
+		errorMsg("%v", err)
+		os.Exit(1)
+	}
+
+	if options.shell != "" {
+		if err := checkShell(options.shell); err != nil {
+			errorMsg("%v", err)
+			os.Exit(2)
+		}
+	}
+
+	if options.noColor {
+		options.color = "never"
+	}
+	switch options.color {
+	case "auto":
+		// Honor NO_COLOR (https://no-color.org) and keep redirected output clean
+		if os.Getenv("NO_COLOR") != "" ||
+			(!isatty.IsTerminal(os.Stdout.Fd()) && !isatty.IsCygwinTerminal(os.Stdout.Fd())) {
+			color.NoColor = true
+		}
+	case "always":
+		color.NoColor = false
+	case "never":
+		color.NoColor = true
+	default:
+		errorMsg("invalid --color '%s', expected auto, always or never", options.color)
+		os.Exit(2)
+	}
+
+	cmdNodes, err := loadDoc(inputFiles, options.timeout)
+	if err != nil {
+		errorMsg("%v", err)
+		os.Exit(1)
+	}
+	rootNodes = cmdNodes
+
+	os.Setenv("MD_EXE", os.Args[0])
+	os.Setenv("MD_FILE", inputFiles[0])
+
+	// Split args into heading paths and code block args
+	invocations, err := splitInvocations(commandArgs())
+	if err != nil {
+		errorMsg("%v", err)
+		os.Exit(2)
+	}
+	headingPath, subCmdArgs := invocations[0].path, invocations[0].args
+	if !options.sequence {
+		headingPath = joinHeadingWords(cmdNodes, headingPath)
+	}
+
+	if options.help {
+		showHelp()
+		return
+	}
+
+	if options.describe {
+		if err := describeCommands(cmdNodes); err != nil {
+			errorMsg("encoding description: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if options.check {
+		if err := checkDoc(cmdNodes); err != nil {
+			errorMsg("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if options.lint {
+		if err := lintDoc(cmdNodes); err != nil {
+			errorMsg("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	forwardSignals()
+
+	if options.watch {
+		if len(headingPath) == 0 {
+			headingPath = []string{defaultCommand}
+		}
+		watchDoc(inputFiles, headingPath, subCmdArgs)
+		return
+	}
+
+	if len(headingPath) == 0 {
+		if options.json {
+			if err := showCommandsJSON(cmdNodes); err != nil {
+				errorMsg("encoding JSON: %v", err)
+			}
+			return
+		}
+
+		// Without a default command, pick a command interactively on a terminal
+		terminal := isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd()) && isatty.IsTerminal(os.Stderr.Fd())
+		_, hasDefault := findCmdNode(cmdNodes, []string{defaultCommand}, 0)
+		if options.interactive || (terminal && !options.list && !hasDefault) {
+			// Fall back to listing when there is no terminal to pick from
+			if !terminal {
+				listCommands(cmdNodes, listFilter)
+				return
+			}
+			path, err := pickCommand(flattenCommands(cmdNodes))
+			if err != nil {
+				errorMsg("%v", err)
+				os.Exit(1)
+			}
+			headingPath = path
+		}
+	}
+
+	if len(headingPath) == 0 {
+		// Run the command named "default" if there is one, otherwise list commands
+		_, hasDefault := findCmdNode(cmdNodes, []string{defaultCommand}, 0)
+		if !hasDefault && len(subCmdArgs) > 0 {
+			errorMsg("no command given for args after --")
+			os.Exit(2)
+		}
+		if options.list || !hasDefault {
+			listCommands(cmdNodes, listFilter)
+			return
+		}
+		headingPath = []string{defaultCommand}
+	}
+
+	// Unknown commands fail before any command or hook runs
+	if !options.sequence {
+		check := invocations
+		if len(invocations) == 1 {
+			check = []invocation{{path: headingPath}}
+		}
+		if err := checkInvocations(cmdNodes, check); err != nil {
+			errorMsg("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	// The global hooks run around the command, the post hook also after a failure
+	runErr := runHook(cmdNodes, options.preHook)
+	if runErr == nil {
+		if len(invocations) > 1 {
+			runErr = runInvocations(cmdNodes, invocations)
+		} else if label, isLabel := blockLabel(headingPath); isLabel {
+			runErr = runLabeledBlock(cmdNodes, label, subCmdArgs)
+		} else if options.sequence {
+			runErr = runSequence(cmdNodes, headingPath, subCmdArgs)
+		} else {
+			var found bool
+			found, runErr = findAndExecuteNestedCommand(cmdNodes, headingPath, subCmdArgs, 0)
+			if !found {
+				runErr = notFoundError(cmdNodes, headingPath)
+			}
+		}
+	}
+	if err := runHook(cmdNodes, options.postHook); err != nil {
+		runErr = errors.Join(runErr, err)
+	}
+
+	printTotalTime()
+
+	if options.junit != "" {
+		if err := writeJUnitReport(options.junit, runResults); err != nil {
+			errorMsg("writing junit report: %v", err)
+		}
+	}
+
+	if runErr != nil {
+		errorMsg("%v", runErr)
+		os.Exit(exitCode(runErr))
+	}
+}
@@ -0,0 +1,1375 @@
+package mdrun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+)
+
+// Count of files included so far, documents including files are not cached
+// as the cache would miss changes of the included files
+var includeCount int
+
+// blockRetries returns how often a failing codeBlock of cmdNode is run again,
+// set by its retry attribute, the retry env key or --retry
+func blockRetries(cmdNode *cmdNode, codeBlock codeBlock) (int, error) {
+	value, exists := codeBlock.Attrs["retry"]
+	if !exists {
+		value, exists = inheritedEnv(cmdNode, "retry")
+	}
+	if !exists {
+		return options.retry, nil
+	}
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		return 0, fmt.Errorf("invalid retry '%s' of '%s', expected a number", value, getHeadingText(cmdNode.Heading))
+	}
+	return retries, nil
+}
+
+// Helpers available to template code blocks
+var templateFuncs = template.FuncMap{
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"trim":     strings.TrimSpace,
+	"join":     func(sep string, elems []string) string { return strings.Join(elems, sep) },
+	"split":    func(sep string, s string) []string { return strings.Split(s, sep) },
+	"contains": func(substr string, s string) bool { return strings.Contains(s, substr) },
+	"replace":  func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"quote":    func(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" },
+	"default": func(def string, value interface{}) interface{} {
+		if value == nil || value == "" {
+			return def
+		}
+		return value
+	},
+	"arg": func(i int, args []string) string {
+		if i < 0 || i >= len(args) {
+			return ""
+		}
+		return args[i]
+	},
+}
+
+// renderTemplate renders a code block marked as template with the given
+// env and args as context, e.g. {{.Env.HOME}} or {{index .Args 0}}
+func renderTemplate(code string, env map[string]string, args []string) (string, error) {
+	tmpl, err := template.New("codeblock").Funcs(templateFuncs).Option("missingkey=zero").Parse(code)
+	if err != nil {
+		return "", fmt.Errorf("parsing template: %w", err)
+	}
+
+	var sb strings.Builder
+	data := struct {
+		Env  map[string]string
+		Args []string
+	}{env, args}
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("rendering template: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// Matches {{name}} and {{name:default}} placeholders
+var placeholderRegexp = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)(:[^}]*)?\s*\}\}`)
+
+// substitutePlaceholders fills {{name}} placeholders in code from vars, a
+// placeholder without value errors unless it has a default {{name:default}}
+func substitutePlaceholders(code string, vars map[string]string) (string, error) {
+	var missing []string
+	code = placeholderRegexp.ReplaceAllStringFunc(code, func(match string) string {
+		groups := placeholderRegexp.FindStringSubmatch(match)
+		name, def := groups[1], groups[2]
+		if value, exists := vars[name]; exists {
+			return value
+		}
+		if def != "" {
+			return strings.TrimSpace(def[1:])
+		}
+		missing = append(missing, name)
+		return match
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing value for placeholders: %s, use --arg NAME=VALUE", strings.Join(missing, ", "))
+	}
+	return code, nil
+}
+
+// runResult records the outcome of an executed cmdNode
+type runResult struct {
+	Path     string
+	Duration time.Duration
+	Output   string
+	Err      error
+}
+
+// The streams of code blocks, Run may redirect them
+var (
+	codeStdin              io.Reader = os.Stdin
+	codeStdout, codeStderr io.Writer = os.Stdout, os.Stderr
+)
+
+// Results of executed cmdNodes, collected for --junit
+var runResults []runResult
+
+// Time spent running code blocks, summed up for --time
+var totalTime time.Duration
+
+// printTotalTime prints the time spent running code blocks with --time
+func printTotalTime() {
+	if options.time && totalTime > 0 {
+		infoMsg("total: %.2fs", totalTime.Seconds())
+	}
+}
+
+// resolveEnv merges the env tables of cmdNode and its parents, ensuring the
+// current node's variables take precedence, and the variables set by mdrun.
+// Values may reference variables with $VAR or ${VAR}, expanded against the
+// variables set by parent headings and the inherited environment.
+func resolveEnv(cmdNode cmdNode, codeBlock codeBlock, headingPath []string) map[string]string {
+	envMap := make(map[string]string)
+	lookup := func(key string) string {
+		if value, exists := envMap[key]; exists {
+			return value
+		}
+		return os.Getenv(key)
+	}
+	var chain []map[string]string
+	for parent := cmdNode.Parent; parent != nil; parent = parent.Parent {
+		chain = append([]map[string]string{parent.Env}, chain...)
+	}
+	chain = append([]map[string]string{baseEnv}, chain...)
+	for i, env := range append(chain, exportedEnv, cmdNode.Env) {
+		expanded := make(map[string]string)
+		var unset []string
+		for key, value := range env {
+			if reservedEnvKeys[key] {
+				continue
+			}
+			// The base env and exports are values, not env table markers
+			isTable := i != 0 && i != len(chain)
+			if isTable && value == unsetValue {
+				unset = append(unset, key)
+				continue
+			}
+			if isTable && isRequiredValue(value) {
+				// Required keys keep the value of the environment
+				_, exported := exportedEnv[key]
+				_, inBase := baseEnv[key]
+				if !exported && !inBase {
+					delete(envMap, key)
+				}
+				continue
+			}
+			if i == len(chain) { // Exported values are used verbatim
+				expanded[key] = value
+			} else {
+				expanded[key] = os.Expand(value, lookup)
+			}
+		}
+		for key, value := range expanded {
+			envMap[key] = value
+		}
+		for _, key := range unset {
+			delete(envMap, key)
+		}
+	}
+	envMap["MD_FILE"] = codeBlock.File
+	envMap["MD_HEADING"] = getHeadingText(cmdNode.Heading)
+	envMap["MD_HEADING_PATH"] = strings.Join(headingPath, " ")
+	envMap["MD_HEADING_LEVEL"] = strconv.Itoa(cmdNode.Heading.Level)
+	envMap["MD_PATH"] = strings.Join(headingTrail(cmdNode), " > ")
+
+	// Block attributes other than the reserved settings override the env table
+	for key, value := range codeBlock.Attrs {
+		switch key {
+		case "id", "name", "cwd", "skip", "shell", "image", "retry", "os", "order":
+		default:
+			envMap[key] = value
+		}
+	}
+
+	return envMap
+}
+
+// headingTrail returns the heading texts from the top level command down to
+// cmdNode, found by walking its parents
+func headingTrail(cmdNode cmdNode) []string {
+	var trail []string
+	for node := &cmdNode; node != nil && node.Heading.Level >= options.runBaseLevel; node = node.Parent {
+		trail = append([]string{getHeadingText(node.Heading)}, trail...)
+	}
+	return trail
+}
+
+// renderCode returns the code of codeBlock with templates rendered or
+// placeholders substituted. Both are opt-in by a flag, as code often contains
+// {{ }} of its own, e.g. go templates of helm or kubectl.
+func renderCode(codeBlock codeBlock, envMap map[string]string, args []string) (string, error) {
+	code := string(codeBlock.Literal)
+	if codeBlock.hasFlag("placeholders") {
+		return substitutePlaceholders(code, options.vars)
+	}
+	if !codeBlock.hasFlag("template") {
+		return code, nil
+	}
+
+	templateEnv := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			templateEnv[key] = value
+		}
+	}
+	for key, value := range envMap {
+		templateEnv[key] = value
+	}
+	return renderTemplate(code, templateEnv, args)
+}
+
+// execCmdNode runs the code blocks of cmdNode, headingPath is the lowercased
+// path the node was matched by
+func execCmdNode(cmdNode cmdNode, headingPath []string, args []string) (err error) {
+	key := nodeKey(cmdNode)
+	if visitingNodes[key] {
+		return fmt.Errorf("dependency cycle detected at '%s'", getHeadingText(cmdNode.Heading))
+	}
+	visitingNodes[key] = true
+	defer delete(visitingNodes, key)
+
+	if err := runDependencies(cmdNode); err != nil {
+		return err
+	}
+
+	// With --hooks the sub headings pre and post run around the code blocks
+	if options.hooks {
+		if pre, exists := hookNode(cmdNode, "pre"); exists {
+			if err := execCmdNode(pre, append(slices.Clip(headingPath), "pre"), args); err != nil {
+				return err
+			}
+		}
+		if post, exists := hookNode(cmdNode, "post"); exists {
+			defer func() {
+				if err == nil {
+					err = execCmdNode(post, append(slices.Clip(headingPath), "post"), args)
+				}
+			}()
+		}
+	}
+
+	codeBlocks := cmdNode.runBlocks()
+	if len(codeBlocks) > 0 {
+		if missing := cmdNode.missingEnv(); len(missing) > 0 {
+			hint := ""
+			if options.cleanEnv {
+				hint = ", pass them with --env-passthrough"
+			}
+			return fmt.Errorf("missing required env for '%s': %s%s", getHeadingText(cmdNode.Heading), strings.Join(missing, ", "), hint)
+		}
+	}
+
+	stdout, stderr := codeStdout, codeStderr
+	if options.outputPrefix || inParallel {
+		prefix := "[" + strings.Join(headingPath, " ") + "] "
+		prefixedStdout, prefixedStderr := newPrefixWriter(stdout, prefix), newPrefixWriter(stderr, prefix)
+		defer prefixedStdout.Flush()
+		defer prefixedStderr.Flush()
+		stdout, stderr = prefixedStdout, prefixedStderr
+	}
+
+	if options.junit != "" && len(codeBlocks) > 0 {
+		output := new(bytes.Buffer)
+		var outputLock sync.Mutex
+		stdout = io.MultiWriter(stdout, syncWriter{&outputLock, output})
+		stderr = io.MultiWriter(stderr, syncWriter{&outputLock, output})
+
+		start := time.Now()
+		defer func() {
+			runResults = append(runResults, runResult{
+				Path:     strings.Join(headingPath, " "),
+				Duration: time.Since(start),
+				Output:   output.String(),
+				Err:      err,
+			})
+		}()
+	}
+
+	var nodeTime time.Duration
+	timed := false
+	if options.time {
+		defer func() {
+			if timed {
+				infoMsg("%s: %.2fs", strings.Join(headingPath, " "), nodeTime.Seconds())
+				totalTime += nodeTime
+			}
+		}()
+	}
+
+	blockFound := false
+	var failures []error
+	for i, codeBlock := range codeBlocks {
+		if err := checkInterrupted(); err != nil {
+			return err
+		}
+		if codeBlock.skipped() || !codeBlock.selected() {
+			continue
+		}
+		if options.block != "" {
+			if codeBlock.Attrs["name"] != options.block {
+				continue
+			}
+			blockFound = true
+		}
+
+		// Lookup language configuration
+		config, exists := languageConfigs[codeBlock.Lang]
+		if !exists {
+			return fmt.Errorf("unsupported code block type: %s", codeBlock.Lang)
+		}
+		if goos, exists := platformLanguages[codeBlock.Lang]; exists && goos != runtime.GOOS && !options.dryRun {
+			return fmt.Errorf("code block type '%s' is unsupported on this platform (%s), it only runs on %s", codeBlock.Lang, runtime.GOOS, goos)
+		}
+		shell := options.shell
+		if codeBlock.DocShell != "" {
+			shell = codeBlock.DocShell
+		}
+		if shell != "" && shellLanguages[codeBlock.Lang] {
+			config = shellConfig(shell, config)
+		}
+
+		envMap := resolveEnv(cmdNode, codeBlock, headingPath)
+
+		exportFile, err := os.CreateTemp("", programName+"-export-*")
+		if err != nil {
+			return fmt.Errorf("creating export file: %w", err)
+		}
+		exportFile.Close()
+		defer os.Remove(exportFile.Name())
+		envMap["MD_EXPORT"] = exportFile.Name()
+
+		code, err := renderCode(codeBlock, envMap, args)
+		if err != nil {
+			return err
+		}
+
+		// Replace $CODE placeholder with the actual code block
+		prefixArgs := make([]string, len(config.prefixArgs))
+		for i, arg := range config.prefixArgs {
+			prefixArgs[i] = strings.Replace(arg, "$CODE", code, 1)
+		}
+
+		cmdArgs := append(prefixArgs, args...)
+
+		cmdName := config.cmdName
+		if shell, exists := codeBlock.Attrs["shell"]; exists {
+			cmdName = shell
+		}
+
+		prepare := config.prepare
+		hasShebang := options.shebang && strings.HasPrefix(code, "#!")
+		if hasShebang {
+			prepare = prepareShebang
+			shebang, _, _ := strings.Cut(code, "\n")
+			cmdName = strings.TrimSpace(shebang[2:])
+		}
+
+		if options.dryRun {
+			if prepare != nil {
+				cmdArgs = append([]string{"<" + codeBlock.Lang + " code block>"}, args...)
+			}
+			printPlanStep(headingPath, codeBlock, cmdName, cmdArgs)
+			continue
+		}
+
+		run := localBackend
+		image, exists := codeBlock.Attrs["image"]
+		if !exists {
+			image, _ = inheritedEnv(&cmdNode, "image")
+		}
+		if image != "" {
+			// A leading dash would be taken as a docker flag
+			if strings.HasPrefix(image, "-") {
+				return fmt.Errorf("invalid image '%s'", image)
+			}
+			// Docker runs through its daemon with network access, outside the sandbox
+			if options.sandbox {
+				return fmt.Errorf("refusing to run in image %s with --sandbox", image)
+			}
+			if prepare != nil {
+				return fmt.Errorf("image is not supported for %s code blocks", codeBlock.Lang)
+			}
+			run = dockerBackend(image)
+		} else if !hasShebang {
+			cmdName = availableInterpreter(cmdName)
+			if err := checkInterpreter(cmdName, codeBlock.Lang); err != nil {
+				return err
+			}
+		}
+		if options.sandbox {
+			home, err := os.MkdirTemp("", programName+"-home-*")
+			if err != nil {
+				return fmt.Errorf("creating sandbox home: %w", err)
+			}
+			defer os.RemoveAll(home)
+			run = sandboxBackend(home)
+		}
+
+		if isRemote(codeBlock.File) && !options.allowRemote {
+			return fmt.Errorf("refusing to run code from %s, use --allow-remote to run remote documents", codeBlock.File)
+		}
+
+		if codeBlock.hasFlag("confirm") && !options.yes {
+			if err := confirm(getHeadingText(cmdNode.Heading)); err != nil {
+				return err
+			}
+		}
+
+		if prepare != nil {
+			name, prepareArgs, cleanup, err := prepare(code)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			cmdName, cmdArgs = name, append(prepareArgs, args...)
+		}
+
+		// Execute the command
+		// The cwd attribute overrides the workdir env key
+		dir, exists := codeBlock.Attrs["cwd"]
+		if !exists {
+			dir, exists = inheritedEnv(&cmdNode, "workdir")
+			dir = os.Expand(dir, func(key string) string {
+				if value, exists := envMap[key]; exists {
+					return value
+				}
+				return os.Getenv(key)
+			})
+		}
+		// Relative directories are resolved against a local markdown file
+		if exists && !filepath.IsAbs(dir) && !isRemote(codeBlock.File) {
+			dir = filepath.Join(filepath.Dir(codeBlock.File), dir)
+		}
+		retries, err := blockRetries(&cmdNode, codeBlock)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		for attempt := 1; ; attempt++ {
+			var cmd *exec.Cmd
+			cmd, err = run(cmdName, cmdArgs, envMap, dir)
+			if err != nil {
+				return err
+			}
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			cmd.Stdin = codeStdin
+			if options.stdin != "" && options.stdin != "-" {
+				stdinFile, err := os.Open(options.stdin)
+				if err != nil {
+					return fmt.Errorf("opening stdin file: %w", err)
+				}
+				defer stdinFile.Close()
+				cmd.Stdin = stdinFile
+			}
+			// On a terminal the code block shares the foreground process group to
+			// read from it, which also makes Ctrl-C reach the code block directly
+			if !isatty.IsTerminal(os.Stdin.Fd()) {
+				setProcessGroup(cmd)
+			}
+			err = runForwarded(cmd)
+
+			// Only non-zero exits are retried, not programs failing to start or
+			// a shell's 126 and 127 for a command not executable or not found
+			var exitErr *exec.ExitError
+			if err == nil || attempt > retries || !errors.As(err, &exitErr) {
+				break
+			}
+			if code := exitErr.ExitCode(); code == 126 || code == 127 {
+				break
+			}
+			errorMsg("%s: code block %d failed with %v, retrying (%d/%d)", strings.Join(headingPath, " "), i+1, err, attempt, retries)
+			if err = sleep(options.retryDelay); err != nil {
+				break
+			}
+		}
+		if options.time {
+			elapsed := time.Since(start)
+			nodeTime += elapsed
+			timed = true
+			if options.verbose > 0 && len(codeBlocks) > 1 {
+				infoMsg("%s [block %d %s]: %.2fs", strings.Join(headingPath, " "), i+1, codeBlock.Lang, elapsed.Seconds())
+			}
+		}
+		if logErr := logExecution(headingPath, codeBlock, start, err); logErr != nil {
+			errorMsg("writing log file: %v", logErr)
+		}
+		if err != nil {
+			err = fmt.Errorf("error executing command %s with args %v: %w", cmdName, cmdArgs, err)
+			if codeBlock.StartLine > 0 && codeBlock.File != "" {
+				err = fmt.Errorf("error in block at %s:%d: %w", codeBlock.File, codeBlock.StartLine, err)
+			} else if codeBlock.StartLine > 0 { // Parsed from a source without file
+				err = fmt.Errorf("error in block at line %d: %w", codeBlock.StartLine, err)
+			}
+			if !keepGoing(err) {
+				return err
+			}
+			failures = append(failures, fmt.Errorf("code block %d (%s) of '%s': %w", i+1, codeBlock.Lang, getHeadingText(cmdNode.Heading), err))
+			continue
+		}
+
+		if err := readExports(exportFile.Name()); err != nil {
+			return fmt.Errorf("reading exports: %w", err)
+		}
+	}
+
+	if options.block != "" && !blockFound && !options.recursive {
+		return fmt.Errorf("no code block named '%s'", options.block)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d code blocks failed:\n%w", len(failures), len(codeBlocks), errors.Join(failures...))
+	}
+
+	return nil
+}
+
+// Top level commands of the document being run, used to resolve dependencies.
+// Main sets it to the loaded document, Run to the document of its node.
+var rootNodes []cmdNode
+
+// Nodes being executed and nodes already run as a dependency, by nodeKey
+var (
+	visitingNodes = make(map[string]bool)
+	finishedDeps  = make(map[string]bool)
+)
+
+// runDependencies runs the commands listed in the "depends" env key of
+// node, e.g. "build, test env". Each entry is a space separated heading
+// path which is looked up among the siblings of node first, then among
+// the siblings of each ancestor and finally among the top level commands.
+// A dependency runs at most once per invocation.
+func runDependencies(node cmdNode) error {
+	depends, exists := node.Env["depends"]
+	if !exists {
+		return nil
+	}
+
+	for _, dep := range strings.Split(depends, ",") {
+		path := strings.Fields(dep)
+		if len(path) == 0 {
+			continue
+		}
+
+		var scopes [][]cmdNode
+		for parent := node.Parent; parent != nil; parent = parent.Parent {
+			scopes = append(scopes, parent.Children)
+		}
+		scopes = append(scopes, rootNodes)
+
+		found := false
+		for _, scope := range scopes {
+			depNode, ok := findCmdNode(scope, path, 0)
+			if !ok {
+				continue
+			}
+			found = true
+			if depNode.skipped() {
+				return fmt.Errorf("dependency '%s' of '%s' is marked skip", strings.TrimSpace(dep), getHeadingText(node.Heading))
+			}
+
+			depKey := nodeKey(depNode)
+			if finishedDeps[depKey] {
+				break
+			}
+			headingPath := make([]string, len(path))
+			for i, heading := range path {
+				headingPath[i] = strings.ToLower(heading)
+			}
+			if err := execCmdNode(depNode, headingPath, nil); err != nil {
+				return fmt.Errorf("dependency '%s' of '%s': %w", strings.TrimSpace(dep), getHeadingText(node.Heading), err)
+			}
+			finishedDeps[depKey] = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("dependency '%s' of '%s' not found", strings.TrimSpace(dep), getHeadingText(node.Heading))
+		}
+	}
+	return nil
+}
+
+// syncWriter serializes writes to a writer shared by the stdout and stderr of
+// a command, which exec.Cmd copies in separate goroutines
+type syncWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (s syncWriter) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(data)
+}
+
+// Serializes the lines of prefixWriters sharing a writer
+var outputMu sync.Mutex
+
+// prefixWriter prepends a prefix to each line written to w. Lines are
+// buffered until complete, so partial writes do not split them.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: prefix}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		outputMu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.buf[:i+1])
+		outputMu.Unlock()
+		if err != nil {
+			return len(data), err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes a last line not ending with a newline
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf)
+	p.buf = nil
+	return err
+}
+
+// exitCode returns the exit code of the failed child process in err, or 1
+func exitCode(err error) int {
+	var interrupted interruptedError
+	if errors.As(err, &interrupted) {
+		return signalExitCode(interrupted.sig)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// confirm asks whether to run heading on stderr and reads the answer from the
+// terminal, it fails unless the answer is yes or when stdin is not a terminal
+func confirm(heading string) error {
+	if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		return fmt.Errorf("'%s' requires confirmation, use --yes to run non-interactively", heading)
+	}
+
+	fmt.Fprintf(os.Stderr, "Run %s? [y/N] ", heading)
+	type reply struct {
+		answer string
+		err    error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		replies <- reply{answer, err}
+	}()
+	var answer string
+	select {
+	case r := <-replies:
+		if r.err != nil && r.err != io.EOF {
+			return fmt.Errorf("reading confirmation: %w", r.err)
+		}
+		answer = r.answer
+	case <-interrupted:
+		fmt.Fprintln(os.Stderr)
+		return checkInterrupted()
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("aborted")
+}
+
+// logEntry is a line of the --log-file audit log
+type logEntry struct {
+	Time     time.Time `json:"time"`
+	Heading  string    `json:"heading"`
+	Lang     string    `json:"lang"`
+	File     string    `json:"file"`
+	Line     int       `json:"line"`
+	ExitCode int       `json:"exitCode"`
+	Duration float64   `json:"duration"` // Seconds
+	Error    string    `json:"error,omitempty"`
+}
+
+// logExecution appends a JSON line about an executed code block to the
+// --log-file
+func logExecution(headingPath []string, codeBlock codeBlock, start time.Time, runErr error) error {
+	if options.logFile == "" {
+		return nil
+	}
+
+	entry := logEntry{
+		Time:     start,
+		Heading:  strings.Join(headingPath, " "),
+		Lang:     codeBlock.Lang,
+		File:     codeBlock.File,
+		Line:     codeBlock.StartLine,
+		Duration: time.Since(start).Seconds(),
+	}
+	if runErr != nil {
+		entry.ExitCode = exitCode(runErr)
+		entry.Error = runErr.Error()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(options.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Number of code blocks printed by --dry-run
+var planSteps int
+
+// printPlanStep prints a code block that would run in --dry-run mode
+func printPlanStep(headingPath []string, codeBlock codeBlock, cmdName string, cmdArgs []string) {
+	planSteps++
+
+	quoted := []string{cmdName}
+	for _, arg := range cmdArgs {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$") {
+			arg = strconv.Quote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+
+	fmt.Printf("%d. %s (%s)\n", planSteps, color.GreenString(strings.Join(headingPath, " ")), codeBlock.Lang)
+	fmt.Printf("   %s\n", strings.Join(quoted, " "))
+}
+
+// Variables exported by executed code blocks, visible to the code blocks
+// that run after them in the same invocation
+var exportedEnv = make(map[string]string)
+
+// Variables given by library callers, overridden by the env tables
+var baseEnv map[string]string
+
+// readExports reads the KEY=VALUE lines a code block wrote to $MD_EXPORT
+func readExports(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid line %q, expected KEY=VALUE", line)
+		}
+		exportedEnv[key] = value
+	}
+	return nil
+}
+
+// isHook reports whether cmdNode is a pre or post hook of its parent
+func isHook(cmdNode cmdNode) bool {
+	heading := getHeadingText(cmdNode.Heading)
+	return strings.EqualFold(heading, "pre") || strings.EqualFold(heading, "post")
+}
+
+// hookNode returns the sub heading of node named name, pre or post
+func hookNode(node cmdNode, name string) (cmdNode, bool) {
+	for _, child := range node.Children {
+		if strings.EqualFold(getHeadingText(child.Heading), name) && !child.skipped() {
+			return child, true
+		}
+	}
+	return cmdNode{}, false
+}
+
+// execCmdNodeRecursive runs the code blocks of cmdNode and then those of
+// its children in document order
+func execCmdNodeRecursive(cmdNode cmdNode, headingPath []string, args []string) error {
+	var errs []error
+	if err := execCmdNode(cmdNode, headingPath, args); err != nil {
+		if !keepGoing(err) {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	if options.parallel > 1 && !inParallel && !options.dryRun {
+		return errors.Join(append(errs, execChildrenParallel(cmdNode, headingPath, args))...)
+	}
+	for _, child := range cmdNode.Children {
+		if child.skipped() || options.hooks && isHook(child) {
+			continue
+		}
+		childPath := append(append([]string{}, headingPath...), strings.ToLower(getHeadingText(child.Heading)))
+		if err := execCmdNodeRecursive(child, childPath, args); err != nil {
+			if !keepGoing(err) {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	// Held by the goroutines of a --parallel section except while waiting
+	// for a code block, so they share the run state one at a time
+	execMu sync.Mutex
+	// Whether the children of a command run in parallel, their own children
+	// then run in order within their goroutine
+	inParallel bool
+)
+
+// execChildrenParallel runs the children of cmdNode recursively, at most
+// --parallel at a time. Output lines are prefixed with the heading path.
+// All children run, failures are reported together.
+func execChildrenParallel(cmdNode cmdNode, headingPath []string, args []string) error {
+	inParallel = true
+	defer func() { inParallel = false }()
+
+	slots := make(chan struct{}, options.parallel)
+	errs := make([]error, len(cmdNode.Children))
+	var wg sync.WaitGroup
+	for i, child := range cmdNode.Children {
+		if child.skipped() || options.hooks && isHook(child) {
+			continue
+		}
+		childPath := append(append([]string{}, headingPath...), strings.ToLower(getHeadingText(child.Heading)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			execMu.Lock()
+			defer execMu.Unlock()
+			errs[i] = execCmdNodeRecursive(child, childPath, args)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+// writeJUnitReport writes the collected run results as a junit XML report
+func writeJUnitReport(file string, results []runResult) error {
+	suite := junitTestSuite{Name: programName}
+	var total time.Duration
+	for _, result := range results {
+		testCase := junitTestCase{
+			Name:      result.Path,
+			ClassName: programName,
+			Time:      fmt.Sprintf("%.3f", result.Duration.Seconds()),
+		}
+		if result.Err != nil {
+			testCase.Failure = &junitFailure{Message: result.Err.Error(), Output: result.Output}
+			suite.Failures++
+		} else {
+			testCase.SystemOut = result.Output
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+		total += result.Duration
+	}
+	suite.Tests = len(suite.TestCases)
+	suite.Time = fmt.Sprintf("%.3f", total.Seconds())
+
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
+
+// printEnv prints the env mdrun sets for the code blocks of cmdNode sorted by
+// key, marking keys which override a parent heading or the environment
+func printEnv(cmdNode cmdNode, headingPath []string) {
+	envMap := resolveEnv(cmdNode, codeBlock{File: nodeFile(cmdNode)}, headingPath)
+	keys := make([]string, 0, len(envMap))
+	for key := range envMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		line := key + "=" + envMap[key]
+		if _, own := cmdNode.Env[key]; own {
+			_, fromParent := inheritedEnv(cmdNode.Parent, key)
+			_, fromEnviron := os.LookupEnv(key)
+			if fromParent || fromEnviron {
+				line += color.YellowString(" (overrides inherited)")
+			}
+		}
+		fmt.Println(line)
+	}
+}
+
+// printCmdNode prints the code blocks of cmdNode as they would be run, with
+// placeholders substituted, separated by an empty line. With --verbose each
+// block is fenced with its language.
+func printCmdNode(cmdNode cmdNode, headingPath []string, args []string) error {
+	printed := 0
+	for _, codeBlock := range cmdNode.runBlocks() {
+		// The same code blocks as execCmdNode runs
+		if codeBlock.skipped() || !codeBlock.selected() {
+			continue
+		}
+		if options.block != "" && codeBlock.Attrs["name"] != options.block {
+			continue
+		}
+		code, err := renderCode(codeBlock, resolveEnv(cmdNode, codeBlock, headingPath), args)
+		if err != nil {
+			return err
+		}
+
+		if printed > 0 {
+			fmt.Println()
+		}
+		printed++
+		if options.verbose > 0 {
+			fmt.Printf("```%s\n%s```\n", codeBlock.Lang, code)
+		} else {
+			fmt.Print(code)
+		}
+	}
+	if options.block != "" && printed == 0 {
+		return fmt.Errorf("no code block named '%s'", options.block)
+	}
+	return nil
+}
+
+// findCmdNode returns the node matching path, matched the same way as
+// findAndExecuteNestedCommand
+func findCmdNode(nodes []cmdNode, path []string, currentDepth int) (cmdNode, bool) {
+	if currentDepth >= len(path) {
+		return cmdNode{}, false
+	}
+
+	for _, node := range nodes {
+		if node.Heading.Level < options.runBaseLevel {
+			if found, ok := findCmdNode(node.Children, path, currentDepth); ok {
+				return found, true
+			}
+			continue
+		}
+
+		if matchHeading(node, path[currentDepth]) {
+			if currentDepth == len(path)-1 {
+				return node, true
+			}
+			if found, ok := findCmdNode(node.Children, path, currentDepth+1); ok {
+				return found, true
+			}
+		}
+	}
+	return cmdNode{}, false
+}
+
+// findAndExecuteNestedCommand executes the command matching path, it reports
+// whether the command was found and the error of executing it
+func findAndExecuteNestedCommand(nodes []cmdNode, path []string, args []string, currentDepth int) (bool, error) {
+	if currentDepth >= len(path) {
+		return false, nil
+	}
+
+	targetHeading := path[currentDepth]
+	for _, node := range nodes {
+		// Skip headers below the run base level and only process deeper headers
+		if node.Heading.Level < options.runBaseLevel {
+			// Search through their subcommands directly
+			if found, err := findAndExecuteNestedCommand(node.Children, path, args, currentDepth); found {
+				return true, err
+			}
+			continue
+		}
+
+		if matchHeading(node, targetHeading) {
+			if node.skipped() {
+				return true, fmt.Errorf("'%s' is marked skip and can not be run", getHeadingText(node.Heading))
+			}
+			if currentDepth == len(path)-1 {
+				headingPath := make([]string, len(path))
+				for i, heading := range path {
+					headingPath[i] = strings.ToLower(heading)
+				}
+				return true, runCmdNode(node, headingPath, args)
+			}
+			// Continue searching in subcommands
+			if found, err := findAndExecuteNestedCommand(node.Children, path, args, currentDepth+1); found {
+				return true, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// runCmdNode runs a found cmdNode, or prints its code or env with --print or
+// --list-env
+func runCmdNode(node cmdNode, headingPath []string, args []string) error {
+	if options.print {
+		return printCmdNode(node, headingPath, args)
+	}
+	if options.listEnv {
+		printEnv(node, headingPath)
+		return nil
+	}
+	if options.recursive {
+		return execCmdNodeRecursive(node, headingPath, args)
+	}
+	return execCmdNode(node, headingPath, args)
+}
+
+// labeledBlock is a code block labeled with an id, e.g. {.sh #migrate-up}
+type labeledBlock struct {
+	node  cmdNode
+	path  []string // Lower cased heading path of node
+	block codeBlock
+}
+
+// labeledBlocks indexes the code blocks of all headings by their id, the first
+// one wins. It also returns the ids used more than once.
+func labeledBlocks(cmdNodes []cmdNode) (map[string]labeledBlock, []string) {
+	labels := make(map[string]labeledBlock)
+	var duplicates []string
+	var walk func(nodes []cmdNode, path []string)
+	walk = func(nodes []cmdNode, path []string) {
+		for _, node := range nodes {
+			// Like their headings, code blocks under a skipped heading can not run
+			if node.skipped() {
+				continue
+			}
+			nodePath := path
+			if node.Heading.Level >= options.runBaseLevel {
+				nodePath = append(append([]string{}, path...), strings.ToLower(getHeadingText(node.Heading)))
+			}
+			for _, block := range node.CodeBlocks {
+				id, exists := block.Attrs["id"]
+				if !exists {
+					continue
+				}
+				if _, exists := labels[id]; exists {
+					duplicates = append(duplicates, id)
+					continue
+				}
+				labels[id] = labeledBlock{node: node, path: nodePath, block: block}
+			}
+			walk(node.Children, nodePath)
+		}
+	}
+	walk(cmdNodes, nil)
+	return labels, duplicates
+}
+
+// blockLabel returns the id of a '#id' path naming a labeled code block
+func blockLabel(path []string) (string, bool) {
+	if len(path) != 1 {
+		return "", false
+	}
+	return strings.CutPrefix(path[0], "#")
+}
+
+// runLabeledBlock runs the code block labeled with id as the only code block
+// of its heading
+func runLabeledBlock(cmdNodes []cmdNode, id string, args []string) error {
+	labels, _ := labeledBlocks(cmdNodes)
+	labeled, exists := labels[id]
+	if !exists {
+		return fmt.Errorf("no code block labeled '#%s'", id)
+	}
+	node := labeled.node
+	node.CodeBlocks = []codeBlock{labeled.block}
+	return runCmdNode(node, labeled.path, args)
+}
+
+// runHook runs the command at the space separated heading path given by
+// --pre-hook or --post-hook, nothing if it is empty or the command is only
+// printed or planned
+func runHook(cmdNodes []cmdNode, heading string) error {
+	if heading == "" || options.print || options.listEnv || options.dryRun {
+		return nil
+	}
+	path := joinHeadingWords(cmdNodes, strings.Fields(heading))
+	found, err := findAndExecuteNestedCommand(cmdNodes, path, nil, 0)
+	if !found {
+		return fmt.Errorf("hook: %w", notFoundError(cmdNodes, path))
+	}
+	return err
+}
+
+// invocation is a heading path with the args for its code blocks
+type invocation struct {
+	path []string
+	args []string
+}
+
+// splitInvocations splits command line args into invocations separated by
+// "+", each a heading path optionally followed by "--" and its args. Only the
+// first "--" of an invocation separates, later ones are args, and "++" in the
+// args is a literal "+". A heading path is empty when the args start with
+// "--", which is an error when there are several invocations.
+func splitInvocations(args []string) ([]invocation, error) {
+	invocations := []invocation{{}}
+	inArgs := false
+	for _, arg := range args {
+		current := &invocations[len(invocations)-1]
+		switch {
+		case arg == "+":
+			invocations = append(invocations, invocation{})
+			inArgs = false
+		case arg == "--" && !inArgs:
+			inArgs = true
+		case arg == "++" && inArgs:
+			current.args = append(current.args, "+")
+		case inArgs:
+			current.args = append(current.args, arg)
+		default:
+			current.path = append(current.path, arg)
+		}
+	}
+	if len(invocations) > 1 {
+		for _, invocation := range invocations {
+			if len(invocation.path) == 0 {
+				return nil, errors.New("missing command before or after '+', pass a literal + in args as ++")
+			}
+		}
+	}
+	return invocations, nil
+}
+
+// checkInvocations reports the first command or labeled block of invocations
+// that does not exist, so none of them runs
+func checkInvocations(cmdNodes []cmdNode, invocations []invocation) error {
+	labels, _ := labeledBlocks(cmdNodes)
+	for _, invocation := range invocations {
+		if label, isLabel := blockLabel(invocation.path); isLabel {
+			if _, exists := labels[label]; !exists {
+				return fmt.Errorf("no code block labeled '#%s'", label)
+			}
+			continue
+		}
+		path := joinHeadingWords(cmdNodes, invocation.path)
+		if _, exists := findCmdNode(cmdNodes, path, 0); !exists {
+			return notFoundError(cmdNodes, path)
+		}
+	}
+	return nil
+}
+
+// runInvocations runs the commands of invocations in order, it stops at the
+// first failure unless --keep-going is given
+func runInvocations(cmdNodes []cmdNode, invocations []invocation) error {
+	var errs []error
+	for _, invocation := range invocations {
+		var err error
+		if label, isLabel := blockLabel(invocation.path); isLabel {
+			err = runLabeledBlock(cmdNodes, label, invocation.args)
+		} else {
+			path := joinHeadingWords(cmdNodes, invocation.path)
+			var found bool
+			found, err = findAndExecuteNestedCommand(cmdNodes, path, invocation.args, 0)
+			if !found {
+				err = notFoundError(cmdNodes, path)
+			}
+		}
+		if err != nil {
+			if !keepGoing(err) {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runSequence runs each of headings as a top level command in order, passing
+// args to each. It stops at the first failure unless --keep-going is given.
+func runSequence(cmdNodes []cmdNode, headings []string, args []string) error {
+	var errs []error
+	for _, heading := range headings {
+		found, err := findAndExecuteNestedCommand(cmdNodes, []string{heading}, args, 0)
+		if !found {
+			err = notFoundError(cmdNodes, []string{heading})
+		}
+		if err != nil {
+			if !keepGoing(err) {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// levelNodes returns the commands on the level of nodes, looking through
+// headings above the run base level
+func levelNodes(nodes []cmdNode) []cmdNode {
+	var level []cmdNode
+	for _, node := range nodes {
+		if node.Heading.Level < options.runBaseLevel {
+			level = append(level, levelNodes(node.Children)...)
+		} else if !node.skipped() {
+			level = append(level, node)
+		}
+	}
+	return level
+}
+
+// indexPath returns the path of the command numbered N for a token :N, the
+// number shown by --list counting the runnable commands in document order
+func indexPath(nodes []cmdNode, token string) ([]string, bool) {
+	number, ok := strings.CutPrefix(token, ":")
+	if !ok {
+		return nil, false
+	}
+	index, err := strconv.Atoi(number)
+	if err != nil {
+		return nil, false
+	}
+	paths := flattenCommands(nodes)
+	if index < 1 || index > len(paths) {
+		return nil, false
+	}
+	return paths[index-1], true
+}
+
+// joinHeadingWords joins consecutive words of path which together name a
+// heading, so headings with spaces can be given without quotes. The longest
+// match wins on each level, words after an unmatched one are kept as is.
+func joinHeadingWords(nodes []cmdNode, path []string) []string {
+	if len(path) == 1 {
+		if indexed, exists := indexPath(nodes, path[0]); exists {
+			return indexed
+		}
+	}
+
+	var joined []string
+	level := levelNodes(nodes)
+	for i := 0; i < len(path); {
+		matched := false
+		for n := len(path) - i; n > 0 && !matched; n-- {
+			heading := strings.Join(path[i:i+n], " ")
+			for _, node := range level {
+				if matchHeading(node, heading) {
+					joined = append(joined, heading)
+					level = levelNodes(node.Children)
+					i += n
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return append(joined, path[i:]...)
+		}
+	}
+	return joined
+}
+
+// notFoundError reports a path which does not name a command, with the
+// commands available at the deepest level the path matched as a hint
+func notFoundError(nodes []cmdNode, path []string) error {
+	level := levelNodes(nodes)
+	depth := 0
+	for ; depth < len(path); depth++ {
+		matched := false
+		for _, node := range level {
+			if matchHeading(node, path[depth]) {
+				level = levelNodes(node.Children)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			break
+		}
+	}
+
+	err := fmt.Sprintf("command path '%s' not found", strings.Join(path, " > "))
+	var names []string
+	for _, node := range level {
+		if !node.Hidden {
+			names = append(names, strings.ToLower(getHeadingText(node.Heading)))
+		}
+	}
+	if len(names) == 0 {
+		return errors.New(err)
+	}
+	if depth > 0 {
+		return fmt.Errorf("%s, available under '%s': %s", err, strings.Join(path[:depth], " > "), strings.Join(names, ", "))
+	}
+	return fmt.Errorf("%s, available: %s", err, strings.Join(names, ", "))
+}
+
+// resetRunState clears the state collected while running commands
+func resetRunState() {
+	exportedEnv = make(map[string]string)
+	finishedDeps = make(map[string]bool)
+	runResults = nil
+	totalTime = 0
+	planSteps = 0
+}
@@ -0,0 +1,232 @@
+package mdrun
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Create a map for language configurations
+var languageConfigs = map[string]languageConfig{
+	"awk":        {"awk", []string{"$CODE"}, nil},
+	"sh":         {"sh", []string{"-euc", "$CODE", "--"}, nil},
+	"bash":       {"bash", []string{"-euc", "$CODE", "--"}, nil},
+	"zsh":        {"zsh", []string{"-euc", "$CODE", "--"}, nil},
+	"fish":       {"fish", []string{"-euc", "$CODE", "--"}, nil},
+	"dash":       {"dash", []string{"-euc", "$CODE", "--"}, nil},
+	"ksh":        {"ksh", []string{"-euc", "$CODE", "--"}, nil},
+	"ash":        {"ash", []string{"-euc", "$CODE", "--"}, nil},
+	"shell":      {"sh", []string{"-euc", "$CODE", "--"}, nil},
+	"js":         {"node", []string{"-e", "$CODE"}, nil},
+	"javascript": {"node", []string{"-e", "$CODE"}, nil},
+	"py":         {"python", []string{"-c", "$CODE"}, nil},
+	"python":     {"python", []string{"-c", "$CODE"}, nil},
+	"rb":         {"ruby", []string{"-e", "$CODE"}, nil},
+	"ruby":       {"ruby", []string{"-e", "$CODE"}, nil},
+	"php":        {"php", []string{"-r", "$CODE"}, nil},
+	"cmd":        {cmdName: "cmd.exe", prepare: prepareBatch},
+	"batch":      {cmdName: "cmd.exe", prepare: prepareBatch},
+	"powershell": {"powershell.exe", []string{"-c", "$CODE"}, nil},
+	"pwsh":       {"pwsh", []string{"-c", "$CODE"}, nil},
+	"go":         {cmdName: "go", prepare: prepareGo},
+	"rust":       {cmdName: "rustc", prepare: prepareRust},
+	"rs":         {cmdName: "rustc", prepare: prepareRust},
+}
+
+// Languages which only run on one OS
+var platformLanguages = map[string]string{
+	"cmd": "windows", "batch": "windows",
+}
+
+// Interpreters tried in order when one of them is not installed, Windows
+// PowerShell and PowerShell 7 run the same scripts
+var interpreterAlternatives = map[string][]string{
+	"powershell.exe": {"pwsh"},
+	"pwsh":           {"powershell.exe"},
+}
+
+// Languages run by a shell, affected by --shell
+var shellLanguages = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "fish": true,
+	"dash": true, "ksh": true, "ash": true, "shell": true,
+}
+
+// Define a struct for language configuration
+type languageConfig struct {
+	cmdName    string
+	prefixArgs []string
+	// prepare optionally replaces the $CODE model for languages which need
+	// a file or a compile step, it returns the command to run and a cleanup
+	prepare func(code string) (cmdName string, cmdArgs []string, cleanup func(), err error)
+}
+
+// splitArgs splits a command line by whitespace, keeping quoted words together
+func splitArgs(s string) []string {
+	var args []string
+	var sb strings.Builder
+	var quote rune
+	inWord := false
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			sb.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, sb.String())
+				sb.Reset()
+				inWord = false
+			}
+		default:
+			sb.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		args = append(args, sb.String())
+	}
+	return args
+}
+
+// shellConfig builds the language configuration from --shell, e.g. "bash",
+// "bash -euo pipefail -c" or "$NAME -eu -o pipefail -c $CODE --", where $NAME
+// is the default interpreter of the language. A bare name keeps the default
+// arguments, otherwise $CODE and "--" are appended when missing.
+func shellConfig(shell string, config languageConfig) languageConfig {
+	args := splitArgs(shell)
+	if len(args) == 0 {
+		return config
+	}
+
+	cmdName := strings.ReplaceAll(args[0], "$NAME", config.cmdName)
+	if len(args) == 1 {
+		return languageConfig{cmdName: cmdName, prefixArgs: config.prefixArgs}
+	}
+	prefixArgs := []string{}
+	hasCode := false
+	for _, arg := range args[1:] {
+		hasCode = hasCode || strings.Contains(arg, "$CODE")
+		prefixArgs = append(prefixArgs, strings.ReplaceAll(arg, "$NAME", config.cmdName))
+	}
+	if !hasCode {
+		prefixArgs = append(prefixArgs, "$CODE", "--")
+	}
+	return languageConfig{cmdName: cmdName, prefixArgs: prefixArgs}
+}
+
+// checkShell reports an error when the interpreter of --shell is not found
+func checkShell(shell string) error {
+	args := splitArgs(shell)
+	if len(args) == 0 || strings.Contains(args[0], "$NAME") {
+		return nil
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("invalid --shell '%s': %w", shell, err)
+	}
+	return nil
+}
+
+// availableInterpreter returns cmdName, or an alternative interpreter when
+// cmdName is not installed but the alternative is
+func availableInterpreter(cmdName string) string {
+	if _, err := exec.LookPath(cmdName); err == nil {
+		return cmdName
+	}
+	for _, alternative := range interpreterAlternatives[cmdName] {
+		if _, err := exec.LookPath(alternative); err == nil {
+			return alternative
+		}
+	}
+	return cmdName
+}
+
+// checkInterpreter reports an actionable error when the program running code
+// blocks of lang is not installed, instead of the error of starting it
+func checkInterpreter(cmdName string, lang string) error {
+	if _, err := exec.LookPath(cmdName); err == nil {
+		return nil
+	}
+	where := ""
+	if !strings.ContainsRune(cmdName, filepath.Separator) && !strings.ContainsRune(cmdName, '/') {
+		where = " in PATH"
+	}
+	return fmt.Errorf("interpreter '%s' not found%s for code block type '%s', install it or set another command with [languages.%s] in the config", cmdName, where, lang, lang)
+}
+
+// writeTempSource writes code to a file named name in a new temp directory
+func writeTempSource(code string, name string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", programName+"-*")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(code), 0644); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return file, cleanup, nil
+}
+
+// prepareGo runs a go code block with "go run"
+func prepareGo(code string) (string, []string, func(), error) {
+	file, cleanup, err := writeTempSource(code, "main.go")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return "go", []string{"run", file}, cleanup, nil
+}
+
+// prepareRust compiles a rust code block with rustc and runs the binary
+func prepareRust(code string) (string, []string, func(), error) {
+	file, cleanup, err := writeTempSource(code, "main.rs")
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	binary := filepath.Join(filepath.Dir(file), "main")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	cmd := exec.Command("rustc", "-o", binary, file)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := runForwarded(cmd); err != nil {
+		cleanup()
+		return "", nil, nil, fmt.Errorf("compiling rust code block: %w", err)
+	}
+	return binary, nil, cleanup, nil
+}
+
+// prepareBatch runs a cmd code block as a batch file, "cmd /c" would only
+// run its first line
+func prepareBatch(code string) (string, []string, func(), error) {
+	code = strings.ReplaceAll(strings.ReplaceAll(code, "\r\n", "\n"), "\n", "\r\n")
+	file, cleanup, err := writeTempSource("@echo off\r\n"+code, "main.cmd")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return "cmd.exe", []string{"/d", "/c", file}, cleanup, nil
+}
+
+// prepareShebang runs a code block starting with a shebang line as an
+// executable script
+func prepareShebang(code string) (string, []string, func(), error) {
+	file, cleanup, err := writeTempSource(code, "script")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := os.Chmod(file, 0755); err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+	return file, nil, cleanup, nil
+}
@@ -0,0 +1,470 @@
+package mdrun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/GoToUse/treeprint"
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// jsonCodeBlock is the serializable form of a code block
+type jsonCodeBlock struct {
+	Lang string `json:"lang"`
+	Code string `json:"code"`
+}
+
+// jsonNode is the serializable form of a cmdNode, used by --json
+type jsonNode struct {
+	Heading     string            `json:"heading"`
+	Level       int               `json:"level"`
+	Description string            `json:"description"`
+	Env         map[string]string `json:"env"`
+	CodeBlocks  []jsonCodeBlock   `json:"codeBlocks"`
+	Children    []jsonNode        `json:"children"`
+	Hidden      bool              `json:"hidden,omitempty"`
+}
+
+// walkCommands calls fn with each runnable node and its heading path in
+// document order
+func walkCommands(cmdNodes []cmdNode, fn func(node cmdNode, path []string)) {
+	var walk func(nodes []cmdNode, path []string)
+	walk = func(nodes []cmdNode, path []string) {
+		for _, node := range nodes {
+			if node.Heading.Level < options.runBaseLevel {
+				walk(node.Children, path)
+				continue
+			}
+			if node.skipped() || node.Hidden {
+				continue
+			}
+			nodePath := append(append([]string{}, path...), getHeadingText(node.Heading))
+			if len(node.CodeBlocks) > 0 {
+				fn(node, nodePath)
+			}
+			walk(node.Children, nodePath)
+		}
+	}
+	walk(cmdNodes, nil)
+}
+
+// flattenCommands returns the heading paths of all runnable nodes in
+// document order
+func flattenCommands(cmdNodes []cmdNode) [][]string {
+	var paths [][]string
+	walkCommands(cmdNodes, func(node cmdNode, path []string) {
+		paths = append(paths, path)
+	})
+	return paths
+}
+
+// showCommandsLong prints a line of heading path and description separated
+// by a tab for each runnable node matching filter, for scripts
+func showCommandsLong(w io.Writer, cmdNodes []cmdNode, filter func(cmdNode cmdNode) bool) {
+	walkCommands(cmdNodes, func(node cmdNode, path []string) {
+		if filter != nil && !filter(node) {
+			return
+		}
+		description := strings.Join(strings.Fields(node.Description), " ")
+		fmt.Fprintf(w, "%s\t%s\n", strings.ToLower(strings.Join(path, " ")), description)
+	})
+}
+
+// fuzzyMatch reports whether the characters of pattern appear in s in order,
+// ignoring case
+func fuzzyMatch(pattern string, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		index := strings.IndexRune(s, r)
+		if index < 0 {
+			return false
+		}
+		s = s[index+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// pickCommand lets the user choose one of paths, using fzf when it is
+// installed and a prompt on the terminal otherwise
+func pickCommand(paths [][]string) ([]string, error) {
+	candidates := make([]string, len(paths))
+	for i, path := range paths {
+		candidates[i] = strings.Join(path, " > ")
+	}
+
+	if fzf, err := exec.LookPath("fzf"); err == nil {
+		cmd := exec.Command(fzf, "--prompt", programName+"> ")
+		cmd.Stdin = strings.NewReader(strings.Join(candidates, "\n"))
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("no command selected")
+		}
+		selected := strings.TrimSuffix(string(output), "\n")
+		for i, candidate := range candidates {
+			if candidate == selected {
+				return paths[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no command selected")
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	matches := make([]int, len(candidates))
+	for i := range candidates {
+		matches[i] = i
+	}
+	for {
+		for n, i := range matches {
+			fmt.Fprintf(os.Stderr, "%3d  %s\n", n+1, candidates[i])
+		}
+		fmt.Fprint(os.Stderr, "Select a number or type to filter: ")
+		input, err := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if err != nil && input == "" {
+			return nil, fmt.Errorf("no command selected")
+		}
+
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(matches) {
+			return paths[matches[n-1]], nil
+		}
+
+		var filtered []int
+		for i, candidate := range candidates {
+			if fuzzyMatch(input, candidate) {
+				filtered = append(filtered, i)
+			}
+		}
+		switch len(filtered) {
+		case 0:
+			fmt.Fprintf(os.Stderr, "No command matches '%s'\n", input)
+		case 1:
+			return paths[filtered[0]], nil
+		default:
+			matches = filtered
+		}
+	}
+}
+
+// listRoots returns the nodes shown as tree roots, lifting the children of
+// headings below the list base level
+func listRoots(cmdNodes []cmdNode) []cmdNode {
+	var roots []cmdNode
+	for _, cmdNode := range cmdNodes {
+		if cmdNode.Heading.Level < options.listBaseLevel {
+			roots = append(roots, listRoots(cmdNode.Children)...)
+		} else if (len(cmdNode.CodeBlocks) > 0 || len(cmdNode.Children) > 0) && !cmdNode.skipped() && !cmdNode.Hidden {
+			roots = append(roots, cmdNode)
+		}
+	}
+	return roots
+}
+
+// headingFilter builds the predicate selecting listed headings from --grep,
+// a case insensitive substring, or --grep-regexp. It returns nil without one.
+func headingFilter() (func(cmdNode cmdNode) bool, error) {
+	var match func(s string) bool
+	switch {
+	case options.grepRegexp != "":
+		re, err := regexp.Compile(options.grepRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --grep-regexp: %w", err)
+		}
+		match = re.MatchString
+	case options.grep != "":
+		pattern := strings.ToLower(options.grep)
+		match = func(s string) bool {
+			return strings.Contains(strings.ToLower(s), pattern)
+		}
+	default:
+		return nil, nil
+	}
+	return func(cmdNode cmdNode) bool {
+		return match(getHeadingText(cmdNode.Heading)) || match(cmdNode.Description)
+	}, nil
+}
+
+// containsMatch reports whether cmdNode or one of its descendants matches
+// filter, so the branch leading to a match is kept in the listing
+func containsMatch(cmdNode cmdNode, filter func(cmdNode cmdNode) bool) bool {
+	if filter == nil || filter(cmdNode) {
+		return true
+	}
+	for _, child := range cmdNode.Children {
+		if !child.skipped() && containsMatch(child, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// showCommands prints the command tree, only branches containing a heading
+// matching filter are shown unless filter is nil. With verbose 1 the env keys
+// of the headings are shown, from 2 on also their values and code blocks.
+func showCommands(w io.Writer, cmdNodes []cmdNode, verbose countFlag, filter func(cmdNode cmdNode) bool) {
+	if cmdNodes != nil {
+		// Numbers of the runnable commands, which run them as :N
+		indexes := make(map[string]int)
+		walkCommands(cmdNodes, func(node cmdNode, path []string) {
+			indexes[nodeKey(node)] = len(indexes) + 1
+		})
+		indexWidth := len(strconv.Itoa(len(indexes))) + 1
+
+		var treeView func(cmdNode cmdNode, level int, branch treeprint.Tree)
+		treeView = func(cmdNode cmdNode, level int, branch treeprint.Tree) {
+			if options.depth > 0 && level >= options.depth {
+				return
+			}
+			for _, child := range cmdNode.Children {
+				if (len(child.CodeBlocks) > 0 || len(child.Children) > 0) && !child.skipped() && !child.Hidden && containsMatch(child, filter) {
+					branch := branch.AddBranch(getHeadingText(child.Heading))
+
+					treeView(child, level+1, branch)
+				}
+			}
+		}
+
+		var treeViewWithDescription func(cmdNode cmdNode, level int, branch treeprint.Tree, maxLineRuneLen int)
+		treeViewWithDescription = func(cmdNode cmdNode, level int, branch treeprint.Tree, maxLineRuneLen int) {
+			if options.depth > 0 && level >= options.depth {
+				return
+			}
+			for _, child := range cmdNode.Children {
+				if (len(child.CodeBlocks) > 0 || len(child.Children) > 0) && !child.skipped() && !child.Hidden && containsMatch(child, filter) {
+					var sb strings.Builder
+
+					heading := getHeadingText(child.Heading)
+					headingLowerCased := strings.ToLower(heading)
+					sb.WriteString(color.GreenString(headingLowerCased))
+
+					discription := child.Description
+					blankColumn := strings.Repeat(" ", indexWidth+1)
+					indexColumn := blankColumn
+					if index, exists := indexes[nodeKey(child)]; exists {
+						indexColumn = color.YellowString("%-*s", indexWidth, ":"+strconv.Itoa(index)) + " "
+					}
+
+					keys := make([]string, 0, len(child.Env))
+					for k := range child.Env {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					if verbose == 1 && len(keys) > 0 {
+						envPrettied := color.BlueString("env: " + strings.Join(keys, ", "))
+						if discription == "" {
+							discription = envPrettied
+						} else {
+							discription = discription + "\n" + envPrettied
+						}
+					}
+					if verbose >= 2 {
+						for _, k := range keys {
+							envPrettied := color.BlueString(k + "=" + child.Env[k])
+							if discription == "" {
+								discription = envPrettied
+							} else {
+								discription = discription + "\n" + envPrettied
+							}
+						}
+						for _, codeBlock := range child.CodeBlocks {
+							codeBlockTrimmed := strings.TrimSuffix(string(codeBlock.Literal), "\n")
+							codeBlockPrettied := "```" + string(codeBlock.Info) + "\n" + codeBlockTrimmed + "\n```"
+							if discription == "" {
+								discription = codeBlockPrettied
+							} else {
+								discription = discription + "\n" + codeBlockPrettied
+							}
+						}
+					}
+
+					linesOfDescription := strings.Split(discription, "\n")
+					for i, line := range linesOfDescription {
+						divider := "  "
+						if i == 0 {
+							sb.WriteString(divider)
+							sb.WriteString(strings.Repeat(" ", maxLineRuneLen-(level+1)*4-len([]rune(heading))))
+							sb.WriteString(indexColumn)
+						} else {
+							sb.WriteString("\n")
+							sb.WriteString(divider)
+							sb.WriteString(strings.Repeat(" ", maxLineRuneLen-(level+1)*4))
+							sb.WriteString(blankColumn)
+						}
+						sb.WriteString(line)
+					}
+
+					branch := branch.AddBranch(sb.String())
+
+					treeViewWithDescription(child, level+1, branch, maxLineRuneLen)
+				}
+			}
+		}
+
+		for _, cmdNode := range listRoots(cmdNodes) {
+			if !containsMatch(cmdNode, filter) {
+				continue
+			}
+			tree := treeprint.New()
+			treeView(cmdNode, 0, tree)
+			lines := strings.Split(tree.String(), "\n")
+			// Get maxLine length
+			maxLineRuneLen := 0
+			for _, line := range lines {
+				runeLength := len([]rune(line)) // Returns the number of characters (runes)
+				if runeLength > maxLineRuneLen {
+					maxLineRuneLen = runeLength
+				}
+			}
+
+			// fmt.Print(tree.String())
+			// fmt.Printf("longestHeadingPath: %v\n", longestHeadingPath)
+
+			treeWithDescription := treeprint.New()
+			treeWithDescription.SetValue(getHeadingText(cmdNode.Heading))
+			treeViewWithDescription(cmdNode, 0, treeWithDescription, maxLineRuneLen)
+			fmt.Fprintln(w, treeWithDescription.String())
+		}
+
+	}
+}
+
+// listCommands prints the command tree, verbose output not fitting on the
+// terminal is shown through $PAGER, "less -R" by default
+func listCommands(cmdNodes []cmdNode, filter func(cmdNode cmdNode) bool) {
+	if options.long {
+		showCommandsLong(os.Stdout, cmdNodes, filter)
+		return
+	}
+	if options.verbose == 0 || options.noPager || !isatty.IsTerminal(os.Stdout.Fd()) {
+		showCommands(os.Stdout, cmdNodes, options.verbose, filter)
+		return
+	}
+
+	var output bytes.Buffer
+	showCommands(&output, cmdNodes, options.verbose, filter)
+	_, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || bytes.Count(output.Bytes(), []byte("\n")) < height {
+		os.Stdout.Write(output.Bytes())
+		return
+	}
+
+	pager := splitArgs(os.Getenv("PAGER"))
+	if len(pager) == 0 {
+		pager = []string{"less", "-R"}
+	}
+	cmd := exec.Command(pager[0], pager[1:]...)
+	cmd.Stdin = &output
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		os.Stdout.Write(output.Bytes())
+		return
+	}
+	cmd.Wait()
+}
+
+func toJSONNode(cmdNode cmdNode) jsonNode {
+	node := jsonNode{
+		Heading:     getHeadingText(cmdNode.Heading),
+		Level:       cmdNode.Heading.Level,
+		Description: cmdNode.Description,
+		Env:         cmdNode.Env,
+		CodeBlocks:  []jsonCodeBlock{},
+		Children:    []jsonNode{},
+		Hidden:      cmdNode.Hidden,
+	}
+	if node.Env == nil {
+		node.Env = map[string]string{}
+	}
+	for _, codeBlock := range cmdNode.CodeBlocks {
+		node.CodeBlocks = append(node.CodeBlocks, jsonCodeBlock{
+			Lang: codeBlock.Lang,
+			Code: string(codeBlock.Literal),
+		})
+	}
+	for _, child := range cmdNode.Children {
+		if !child.skipped() {
+			node.Children = append(node.Children, toJSONNode(child))
+		}
+	}
+	return node
+}
+
+func showCommandsJSON(cmdNodes []cmdNode) error {
+	nodes := []jsonNode{}
+	for _, cmdNode := range cmdNodes {
+		if !cmdNode.skipped() {
+			nodes = append(nodes, toJSONNode(cmdNode))
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(nodes)
+}
+
+// describedCommand is the metadata of a heading printed by --describe
+type describedCommand struct {
+	Path        []string `json:"path" yaml:"path"`
+	Runnable    bool     `json:"runnable" yaml:"runnable"`
+	Languages   []string `json:"languages" yaml:"languages"`
+	EnvKeys     []string `json:"envKeys" yaml:"envKeys"`
+	Description string   `json:"description" yaml:"description"`
+	Hidden      bool     `json:"hidden,omitempty" yaml:"hidden,omitempty"`
+}
+
+// describeCommands prints the metadata of every heading in document order as
+// JSON, or as YAML with --yaml
+func describeCommands(cmdNodes []cmdNode) error {
+	commands := []describedCommand{}
+	var walk func(nodes []cmdNode, path []string)
+	walk = func(nodes []cmdNode, path []string) {
+		for _, node := range levelNodes(nodes) {
+			command := describedCommand{
+				Path:        append(append([]string{}, path...), getHeadingText(node.Heading)),
+				Runnable:    len(node.CodeBlocks) > 0,
+				Languages:   []string{},
+				EnvKeys:     []string{},
+				Description: node.Description,
+				Hidden:      node.Hidden,
+			}
+			for _, codeBlock := range node.CodeBlocks {
+				if !slices.Contains(command.Languages, codeBlock.Lang) {
+					command.Languages = append(command.Languages, codeBlock.Lang)
+				}
+			}
+			for key := range node.Env {
+				if !reservedEnvKeys[key] {
+					command.EnvKeys = append(command.EnvKeys, key)
+				}
+			}
+			sort.Strings(command.EnvKeys)
+			commands = append(commands, command)
+			walk(node.Children, command.Path)
+		}
+	}
+	walk(cmdNodes, nil)
+
+	if options.yaml {
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		return encoder.Encode(commands)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(commands)
+}
@@ -0,0 +1,391 @@
+// Package mdrun runs markdown codeblocks by their heading. Main implements
+// the command line program, Parse and Run let other programs use the parsing
+// and execution logic.
+package mdrun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+var programName string = baseProgramName(os.Args[0])
+
+// baseProgramName is the executable name without directory or .exe
+// extension, so mdrun.exe on Windows looks for mdrun.md too
+func baseProgramName(arg0 string) string {
+	name := filepath.Base(arg0)
+	if ext := filepath.Ext(name); runtime.GOOS == "windows" && strings.EqualFold(ext, ".exe") {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// Timeout for fetching remote documents
+const defaultTimeout = 30 * time.Second
+
+// Version of the build, set with -ldflags "-X cr/mdrun.version=v1.0.0"
+var version = "dev"
+
+// Heading of the command to run when no heading path is given
+const defaultCommand = "default"
+
+// Command line options
+var options struct {
+	help          bool
+	verbose       countFlag
+	quiet         bool
+	json          bool
+	interactive   bool
+	list          bool
+	recursive     bool
+	dryRun        bool
+	print         bool
+	lint          bool
+	yes           bool
+	keepGoing     bool
+	watch         bool
+	allowRemote   bool
+	shebang       bool
+	timeout       time.Duration
+	listBaseLevel int
+	runBaseLevel  int
+	noColor       bool
+	color         string
+	files         stringsFlag
+	block         string
+	shell         string
+	stdin         string
+	vars          keyValueFlag
+	junit         string
+	logFile       string
+	time          bool
+	config        string
+	rootMarker    string
+	indented      string
+	sequence      bool
+	depth         int
+	grep          string
+	grepRegexp    string
+	noPager       bool
+	noCache       bool
+	outputPrefix  bool
+	check         bool
+	describe      bool
+	yaml          bool
+	onlyLanguages stringsFlag
+	listEnv       bool
+	long          bool
+	sandbox       bool
+	hooks         bool
+	docNames      stringsFlag
+	init          bool
+	cleanEnv      bool
+	version       bool
+	parallel      int
+	preHook       string
+	postHook      string
+	passEnv       stringsFlag
+	retry         int
+	retryDelay    time.Duration
+}
+
+// Env table keys configuring mdrun rather than the environment of code blocks
+var reservedEnvKeys = map[string]bool{
+	"alias":    true,
+	"depends":  true,
+	"skip":     true,
+	"indented": true,
+	"image":    true,
+	"workdir":  true,
+	"inherit":  true,
+	"retry":    true,
+}
+
+// codeBlock wraps ast.CodeBlock with the settings parsed from its info string
+type codeBlock struct {
+	ast.CodeBlock
+	Lang  string            // Language, the first token of the info string
+	Flags []string          // Bare words, e.g. "template"
+	Attrs map[string]string // Key value pairs, e.g. "cwd=/tmp"
+
+	File      string // Markdown file the code block is from
+	DocShell  string // Shell command line set by the frontmatter of File
+	StartLine int    // Line of the opening fence, 0 if unknown
+	EndLine   int    // Line of the closing fence, 0 if unknown
+}
+
+type cmdNode struct {
+	Heading     ast.Heading
+	CodeBlocks  []codeBlock
+	Children    []cmdNode
+	Env         map[string]string
+	Parent      *cmdNode
+	Description string
+	Hidden      bool // Marked by a <!-- mdrun:hidden --> directive, runnable but not listed
+}
+
+// skipped reports whether the env table of cmdNode marks it as skip, such
+// nodes are documentation only and neither listed nor runnable
+func (c cmdNode) skipped() bool {
+	return isTrueValue(c.Env["skip"])
+}
+
+// isTrueValue reports whether an env table value turns a setting on
+func isTrueValue(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "yes", "1":
+		return true
+	}
+	return false
+}
+
+// runBlocks returns the code blocks run for cmdNode. With an env table row
+// inherit = true the blocks of the nearest parent having code blocks run
+// first, limited to the languages compatible with the blocks of cmdNode.
+func (c cmdNode) runBlocks() []codeBlock {
+	own := orderBlocks(c.CodeBlocks)
+	if !isTrueValue(c.Env["inherit"]) {
+		return own
+	}
+	for parent := c.Parent; parent != nil; parent = parent.Parent {
+		if len(parent.CodeBlocks) == 0 {
+			continue
+		}
+		var blocks []codeBlock
+		for _, inherited := range parent.runBlocks() {
+			for _, block := range own {
+				if compatibleLanguages(inherited.Lang, block.Lang) {
+					blocks = append(blocks, inherited)
+					break
+				}
+			}
+		}
+		return append(blocks, own...)
+	}
+	return own
+}
+
+// orderBlocks returns blocks sorted by their order attribute. Blocks with an
+// order run first, lowest first and in document order on ties, then the
+// blocks without one in document order.
+func orderBlocks(blocks []codeBlock) []codeBlock {
+	anyOrdered := slices.ContainsFunc(blocks, func(block codeBlock) bool {
+		_, ordered := block.order()
+		return ordered
+	})
+	if !anyOrdered {
+		return blocks
+	}
+	sorted := slices.Clone(blocks)
+	slices.SortStableFunc(sorted, func(a, b codeBlock) int {
+		orderA, orderedA := a.order()
+		orderB, orderedB := b.order()
+		switch {
+		case orderedA && orderedB:
+			return orderA - orderB
+		case orderedA:
+			return -1
+		case orderedB:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+// compatibleLanguages reports whether code blocks of the languages a and b
+// can share setup, shell languages are compatible with each other
+func compatibleLanguages(a, b string) bool {
+	return a == b || shellLanguages[a] && shellLanguages[b]
+}
+
+// An env table value removing the variable set by a parent heading
+const unsetValue = "!unset"
+
+// isRequiredValue reports whether an env table value marks its key as
+// required, it must then be provided by the environment
+func isRequiredValue(value string) bool {
+	return value == "" || value == "?"
+}
+
+// missingEnv returns the sorted required env keys of cmdNode and its parents
+// which are not set by the environment, the base env of a library run or
+// exported by a previous code block
+func (c cmdNode) missingEnv() []string {
+	required := make(map[string]bool)
+	var chain []map[string]string
+	for node := &c; node != nil; node = node.Parent {
+		chain = append([]map[string]string{node.Env}, chain...)
+	}
+	for _, env := range chain {
+		for key, value := range env {
+			if !reservedEnvKeys[key] {
+				required[key] = isRequiredValue(value)
+			}
+		}
+	}
+
+	// With --clean-env only the passed through variables reach code blocks
+	host := make(map[string]bool)
+	for _, kv := range hostEnv() {
+		key, _, _ := strings.Cut(kv, "=")
+		host[key] = true
+	}
+
+	var missing []string
+	for key, isRequired := range required {
+		if !isRequired {
+			continue
+		}
+		if _, exists := exportedEnv[key]; exists {
+			continue
+		}
+		if _, exists := baseEnv[key]; exists {
+			continue
+		}
+		if !host[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// errorMsg prints error messages to stderr with consistent formatting
+func errorMsg(format string, a ...interface{}) {
+	if options.quiet {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, programName+": "+format+"\n", a...)
+}
+
+// infoMsg prints informational messages to stderr, they are suppressed by
+// --quiet which leaves only the output of code blocks and errors
+func infoMsg(format string, a ...interface{}) {
+	if options.quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+}
+
+func getHeadingText(heading ast.Heading) string {
+	if len(heading.Children) > 0 {
+		if txt, ok := heading.Children[0].(*ast.Text); ok {
+			return string(txt.Literal)
+		}
+	}
+	return ""
+}
+
+// inheritedEnv looks up key in the env table of cmdNode or its closest parent
+// setting it
+func inheritedEnv(cmdNode *cmdNode, key string) (string, bool) {
+	for node := cmdNode; node != nil; node = node.Parent {
+		if value, exists := node.Env[key]; exists {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (c codeBlock) hasFlag(name string) bool {
+	for _, flag := range c.Flags {
+		if flag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// skipped reports whether the block is marked with the skip attribute
+func (c codeBlock) skipped() bool {
+	if c.hasFlag("skip") {
+		return true
+	}
+	skip, exists := c.Attrs["skip"]
+	return exists && skip != "false" && skip != "0"
+}
+
+// forThisOS reports whether the os attribute of the block, e.g. from the info
+// string sh:linux, matches the running OS. unix matches all but windows.
+func (c codeBlock) forThisOS() bool {
+	goos, exists := c.Attrs["os"]
+	if !exists {
+		return true
+	}
+	return goos == runtime.GOOS || goos == "unix" && runtime.GOOS != "windows"
+}
+
+// order returns the order attribute of the block, false if it has none or
+// it is not a number
+func (c codeBlock) order() (int, bool) {
+	order, err := strconv.Atoi(c.Attrs["order"])
+	return order, err == nil
+}
+
+// selected reports whether the language of the block is allowed by
+// --only-language, all languages are when it is not given
+func (c codeBlock) selected() bool {
+	return len(options.onlyLanguages) == 0 || slices.Contains(options.onlyLanguages, c.Lang)
+}
+
+// nodeKey identifies cmdNode by the headings from the document root
+func nodeKey(cmdNode cmdNode) string {
+	key := fmt.Sprintf("%d:%s", cmdNode.Heading.Level, getHeadingText(cmdNode.Heading))
+	for parent := cmdNode.Parent; parent != nil; parent = parent.Parent {
+		key = fmt.Sprintf("%d:%s/%s", parent.Heading.Level, getHeadingText(parent.Heading), key)
+	}
+	return key
+}
+
+// matchHeading reports whether target names cmdNode by its heading or one of
+// the comma separated aliases in its "alias" env key, ignoring case
+func matchHeading(cmdNode cmdNode, target string) bool {
+	if strings.EqualFold(getHeadingText(cmdNode.Heading), target) {
+		return true
+	}
+	for _, alias := range nodeAliases(cmdNode) {
+		if strings.EqualFold(alias, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeAliases(cmdNode cmdNode) []string {
+	var aliases []string
+	for _, alias := range strings.Split(cmdNode.Env["alias"], ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+// isRemote reports whether file is a http(s) URL
+func isRemote(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// nodeFile returns the file of the first code block under cmdNode
+func nodeFile(cmdNode cmdNode) string {
+	if len(cmdNode.CodeBlocks) > 0 {
+		return cmdNode.CodeBlocks[0].File
+	}
+	for _, child := range cmdNode.Children {
+		if file := nodeFile(child); file != "" {
+			return file
+		}
+	}
+	return ""
+}
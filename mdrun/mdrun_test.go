@@ -0,0 +1,213 @@
+package mdrun
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates empty files at the paths relative to dir, with their
+// parent directories
+func writeFiles(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		file := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindDocNamedStopsAtProjectRoot(t *testing.T) {
+	options.rootMarker = ".git"
+	root := t.TempDir()
+	project := filepath.Join(root, "project")
+	deep := filepath.Join(project, "sub", "deep")
+	writeFiles(t, root, "README.md", "project/.git/HEAD", "project/sub/deep/main.go")
+
+	// Nothing in the project, the README.md above it is not used
+	_, err := findDocNamed(deep, []string{"README.md"})
+	var notFound docNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("err = %v, want docNotFoundError", err)
+	}
+	if notFound.project != project {
+		t.Errorf("project = %q, want %q", notFound.project, project)
+	}
+
+	// The nearest document within the project is found
+	writeFiles(t, project, "readme.md", "sub/README.md")
+	file, err := findDocNamed(deep, []string{"README.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(project, "sub", "README.md"); file != want {
+		t.Errorf("file = %q, want %q", file, want)
+	}
+	os.Remove(filepath.Join(project, "sub", "README.md"))
+	file, err = findDocNamed(deep, []string{"README.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(project, "readme.md"); file != want {
+		t.Errorf("file = %q, want %q", file, want)
+	}
+}
+
+func TestFindDocPrecedence(t *testing.T) {
+	options.rootMarker = ".git"
+	t.Setenv("MDRUN_DOC", "")
+	name := programName
+	programName = "cr"
+	defer func() { programName = name }()
+
+	project := t.TempDir()
+	sub := filepath.Join(project, "sub")
+	writeFiles(t, project, ".git/HEAD", "sub/README.md", ".cr.md")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(sub); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		add  string // File added before the search
+		want string
+	}{
+		// A README.md does not shadow a cr.md further up
+		{"", filepath.Join(project, ".cr.md")},
+		// Within a directory cr.md wins over .cr.md
+		{"cr.md", filepath.Join(project, "cr.md")},
+		{"sub/.cr.md", filepath.Join(sub, ".cr.md")},
+		{"sub/cr.md", filepath.Join(sub, "cr.md")},
+	}
+	for _, test := range tests {
+		if test.add != "" {
+			writeFiles(t, project, test.add)
+		}
+		file, err := findDoc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file != test.want {
+			t.Errorf("after adding %q: file = %q, want %q", test.add, file, test.want)
+		}
+	}
+
+	// README.md is the fallback when no cr.md exists up the tree
+	for _, file := range []string{".cr.md", "cr.md", "sub/.cr.md", "sub/cr.md"} {
+		os.Remove(filepath.Join(project, file))
+	}
+	file, err := findDoc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(sub, "README.md"); file != want {
+		t.Errorf("file = %q, want %q", file, want)
+	}
+}
+
+func TestBaseProgramName(t *testing.T) {
+	tests := map[string]string{
+		"mdrun":          "mdrun",
+		"/usr/bin/mdrun": "mdrun",
+		"./mdrun.md":     "mdrun.md",
+	}
+	if runtime.GOOS == "windows" {
+		tests[`C:\tools\mdrun.exe`] = "mdrun"
+		tests["mdrun.EXE"] = "mdrun"
+	} else {
+		tests["mdrun.exe"] = "mdrun.exe"
+	}
+	for arg0, want := range tests {
+		if got := baseProgramName(arg0); got != want {
+			t.Errorf("baseProgramName(%q) = %q, want %q", arg0, got, want)
+		}
+	}
+}
+
+func TestPrepareBatch(t *testing.T) {
+	cmdName, args, cleanup, err := prepareBatch("echo a\necho b\r\necho c\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if cmdName != "cmd.exe" || len(args) != 3 || args[0] != "/d" || args[1] != "/c" {
+		t.Fatalf("command = %s %q, want cmd.exe /d /c FILE", cmdName, args)
+	}
+	content, err := os.ReadFile(args[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "@echo off\r\necho a\r\necho b\r\necho c\r\n"; string(content) != want {
+		t.Errorf("batch file = %q, want %q", content, want)
+	}
+}
+
+func TestSplitInvocations(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []invocation
+	}{
+		// No "--", every word is part of the heading path
+		{[]string{"test", "env"}, []invocation{{path: []string{"test", "env"}}}},
+		// A leading "--" gives args to the default command
+		{[]string{"--", "a"}, []invocation{{args: []string{"a"}}}},
+		// A trailing "--" gives no args
+		{[]string{"test", "sh", "--"}, []invocation{{path: []string{"test", "sh"}}}},
+		// Only the first "--" separates
+		{[]string{"test", "--", "a", "--", "b"}, []invocation{{path: []string{"test"}, args: []string{"a", "--", "b"}}}},
+		{[]string{"a", "--", "1", "+", "b"}, []invocation{{path: []string{"a"}, args: []string{"1"}}, {path: []string{"b"}}}},
+		// "++" is a literal "+" in args
+		{[]string{"a", "--", "1", "++", "2"}, []invocation{{path: []string{"a"}, args: []string{"1", "+", "2"}}}},
+	}
+	for _, test := range tests {
+		got, err := splitInvocations(test.args)
+		if err != nil {
+			t.Errorf("splitInvocations(%q): %v", test.args, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitInvocations(%q) = %+v, want %+v", test.args, got, test.want)
+		}
+	}
+
+	// Every invocation of several needs a command
+	for _, args := range [][]string{{"+"}, {"a", "+"}, {"+", "a"}, {"a", "+", "--", "1"}} {
+		if _, err := splitInvocations(args); err == nil {
+			t.Errorf("splitInvocations(%q) succeeded, want an error", args)
+		}
+	}
+}
+
+func TestCommandArgsKeepsLeadingSeparator(t *testing.T) {
+	args, commandLine := os.Args, flag.CommandLine
+	defer func() { os.Args, flag.CommandLine = args, commandLine }()
+
+	tests := map[string][]string{
+		"-v -- a":   {"--", "a"},
+		"-v a -- b": {"a", "--", "b"},
+		"-v a":      {"a"},
+	}
+	for line, want := range tests {
+		os.Args = append([]string{"cr"}, strings.Fields(line)...)
+		flag.CommandLine = flag.NewFlagSet("cr", flag.ContinueOnError)
+		flag.Bool("v", false, "")
+		if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+			t.Fatal(err)
+		}
+		if got := commandArgs(); !reflect.DeepEqual(got, want) {
+			t.Errorf("commandArgs() for %q = %q, want %q", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,707 @@
+package mdrun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// docNames returns the groups of file names findDoc searches for in order of
+// precedence, given by --doc-name, or comma separated by $MDRUN_DOC. By default
+// {programName}.md and .{programName}.md are searched for before README.md.
+func docNames() [][]string {
+	if len(options.docNames) > 0 {
+		return [][]string{options.docNames}
+	}
+	var names []string
+	for _, name := range strings.Split(os.Getenv("MDRUN_DOC"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		return [][]string{names}
+	}
+	return [][]string{{programName + ".md", "." + programName + ".md"}, {"README.md"}}
+}
+
+// findDoc searches the current and parent directories up to the project root
+// for the document. A group of names is only searched for when no file of the
+// groups before it exists up the tree, so a README.md does not shadow a
+// cr.md further up. Within a directory earlier names of a group win.
+func findDoc() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	var searched []string
+	var notFound docNotFoundError
+	for _, names := range docNames() {
+		searched = append(searched, names...)
+		file, err := findDocNamed(dir, names)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.As(err, &notFound) {
+			return "", err
+		}
+	}
+	if notFound.project != "" {
+		return "", fmt.Errorf("%s not found in project %s", strings.Join(searched, ", "), notFound.project)
+	}
+	return "", fmt.Errorf("%s not found", strings.Join(searched, ", "))
+}
+
+// docNotFoundError is returned by findDocNamed when no file is found, project
+// is the project root the search stopped at if any
+type docNotFoundError struct {
+	project string
+}
+
+func (e docNotFoundError) Error() string {
+	return "document not found"
+}
+
+// findDocNamed searches dir and its parents up to the project root for one of
+// names, ignoring case
+func findDocNamed(dir string, names []string) (string, error) {
+	for {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return "", err
+		}
+
+		for _, name := range names {
+			for _, file := range files {
+				if !file.IsDir() && strings.EqualFold(file.Name(), name) {
+					return filepath.Join(dir, file.Name()), nil
+				}
+			}
+		}
+
+		// Do not leave the project, a document further up is unrelated
+		if _, err := os.Stat(filepath.Join(dir, options.rootMarker)); err == nil {
+			return "", docNotFoundError{project: dir}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir { // Reached the root directory
+			return "", docNotFoundError{}
+		}
+		dir = parent
+	}
+}
+
+// cellText concatenates the inline content of a table cell, such as text,
+// code spans and link texts
+func cellText(cell ast.Node) string {
+	var sb strings.Builder
+	ast.WalkFunc(cell, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch v := node.(type) {
+		case *ast.Text:
+			sb.Write(v.Literal)
+		case *ast.Code:
+			sb.Write(v.Literal)
+		case *ast.Math:
+			// Text between two $ is parsed as math, e.g. ${A}:$PATH
+			sb.WriteString("$" + string(v.Literal) + "$")
+		case *ast.Softbreak, *ast.Hardbreak:
+			sb.WriteString(" ")
+		}
+		return ast.GoToNext
+	})
+	return strings.TrimSpace(sb.String())
+}
+
+// envColumns returns the columns of the key and the value of an env table
+// from its header row. A column named value or default holds the value and one
+// named key, name or variable the key, the first two columns otherwise. Other
+// columns, e.g. a description, are ignored.
+func envColumns(header ast.Node) (int, int) {
+	keyColumn, valueColumn := -1, -1
+	for i, cell := range header.GetChildren() {
+		switch strings.ToLower(cellText(cell)) {
+		case "key", "name", "variable":
+			if keyColumn < 0 {
+				keyColumn = i
+			}
+		case "value", "default":
+			if valueColumn < 0 {
+				valueColumn = i
+			}
+		}
+	}
+	if keyColumn < 0 {
+		keyColumn = 0
+		if valueColumn == 0 {
+			keyColumn = 1
+		}
+	}
+	if valueColumn < 0 {
+		valueColumn = 1
+		if keyColumn == 1 {
+			valueColumn = 0
+		}
+	}
+	return keyColumn, valueColumn
+}
+
+// Matches an HTML comment directive like <!-- mdrun:hidden --> or
+// <!-- mdrun:include ./db.md -->
+var directiveRegexp = regexp.MustCompile(`^<!--\s*mdrun:(\S+)(?:\s+(.*?))?\s*-->\s*$`)
+
+// Languages of code blocks which are shown rather than run, --check does not
+// report them as unsupported
+var plainLanguages = map[string]bool{
+	"text": true, "txt": true, "plain": true, "console": true, "output": true, "log": true,
+	"json": true, "yaml": true, "yml": true, "toml": true, "ini": true, "xml": true,
+	"html": true, "css": true, "diff": true, "md": true, "markdown": true,
+}
+
+// Problems found by parseDoc, reported by --check
+var docProblems []string
+
+// parseDoc builds the command tree of doc, source is the content of the
+// markdown file doc was parsed from and is used to locate code blocks
+func parseDoc(doc ast.Node, source []byte, file string) ([]cmdNode, error) {
+	var commands []cmdNode
+	var includeErr error
+	var stack []*cmdNode    // Track current heading hierarchy
+	offset := 0             // Source offset after the last located code block
+	var directives []string // Directives applying to the next heading
+
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+
+		switch v := node.(type) {
+		case *ast.Heading:
+			cmdNode := cmdNode{Heading: *v}
+			for _, directive := range directives {
+				switch directive {
+				case "hidden":
+					cmdNode.Hidden = true
+				default:
+					if options.verbose > 0 {
+						errorMsg("warning: ignoring unknown directive 'mdrun:%s' before '%s'", directive, getHeadingText(*v))
+					}
+				}
+			}
+			directives = nil
+
+			// Pop stack until we find appropriate parent level
+			for len(stack) > 0 && stack[len(stack)-1].Heading.Level >= v.Level {
+				stack = stack[:len(stack)-1]
+			}
+
+			if len(stack) == 0 {
+				commands = append(commands, cmdNode)
+				stack = append(stack, &commands[len(commands)-1])
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, cmdNode)
+				current := &parent.Children[len(parent.Children)-1]
+				current.Parent = parent
+				stack = append(stack, current)
+			}
+
+		case *ast.Paragraph:
+			if len(stack) > 0 {
+				current := stack[len(stack)-1]
+				if current.Description == "" && len(current.CodeBlocks) == 0 {
+					var description strings.Builder
+					ast.WalkFunc(node, func(child ast.Node, entering bool) ast.WalkStatus {
+						if !entering {
+							return ast.GoToNext
+						}
+
+						switch v := child.(type) {
+						case *ast.Text:
+							description.WriteString(strings.ReplaceAll(string(v.Literal), "\n", " "))
+						case *ast.Hardbreak:
+							description.WriteString("\n")
+						}
+
+						return ast.GoToNext
+					})
+					current.Description = description.String()
+				}
+			}
+
+		case *ast.CodeBlock:
+			if len(stack) > 0 {
+				current := stack[len(stack)-1]
+				codeBlock := newCodeBlock(v)
+				codeBlock.File = file
+				codeBlock.StartLine, codeBlock.EndLine, offset = locateCodeBlock(source, offset, v.Literal)
+				if !v.IsFenced {
+					codeBlock.Lang = indentedLang(current)
+				}
+				if _, ordered := codeBlock.order(); !ordered && codeBlock.Attrs["order"] != "" {
+					docProblems = append(docProblems, fmt.Sprintf("%s:%d: order '%s' is not a number", file, codeBlock.StartLine, codeBlock.Attrs["order"]))
+				}
+				if _, exists := languageConfigs[codeBlock.Lang]; exists {
+					if codeBlock.forThisOS() {
+						current.CodeBlocks = append(current.CodeBlocks, codeBlock)
+					}
+				} else if codeBlock.Lang != "" && !plainLanguages[codeBlock.Lang] {
+					docProblems = append(docProblems, fmt.Sprintf("%s:%d: unsupported code block language '%s' under '%s'", file, codeBlock.StartLine, codeBlock.Lang, getHeadingText(current.Heading)))
+				}
+			}
+
+		case *ast.HTMLBlock:
+			match := directiveRegexp.FindSubmatch(v.Literal)
+			if match == nil {
+				break
+			}
+			if string(match[1]) != "include" {
+				directives = append(directives, string(match[1]))
+				break
+			}
+
+			// The headings of the included file become children of the
+			// current heading, or top level commands before any heading
+			level := 0
+			if len(stack) > 0 {
+				level = stack[len(stack)-1].Heading.Level
+			}
+			included, err := parseInclude(file, string(match[2]), level)
+			if err != nil {
+				includeErr = err
+				return ast.Terminate
+			}
+			if len(stack) == 0 {
+				commands = append(commands, included...)
+			} else {
+				current := stack[len(stack)-1]
+				current.Children = append(current.Children, included...)
+			}
+
+		case *ast.Table:
+			// All tables under a heading are merged into its env, rows of later
+			// tables override rows of earlier ones
+			if len(stack) > 0 {
+				current := stack[len(stack)-1]
+				if current.Env == nil {
+					current.Env = make(map[string]string)
+				}
+				keyColumn, valueColumn := 0, 1
+				ast.WalkFunc(v, func(child ast.Node, entering bool) ast.WalkStatus {
+					if !entering {
+						return ast.GoToNext
+					}
+
+					switch v := child.(type) {
+					case *ast.TableHeader:
+						// The header names the columns, it is not an env row
+						if len(v.Children) > 0 {
+							keyColumn, valueColumn = envColumns(v.Children[0])
+						}
+						return ast.SkipChildren
+					case *ast.TableRow:
+						if len(v.Children) > max(keyColumn, valueColumn) {
+							key, value := cellText(v.Children[keyColumn]), cellText(v.Children[valueColumn])
+							if key != "" {
+								current.Env[key] = value
+								return ast.SkipChildren
+							}
+						}
+						problem := fmt.Sprintf("%s: ignoring env table row under '%s', expected a key and a value", file, getHeadingText(current.Heading))
+						docProblems = append(docProblems, problem)
+						if options.verbose > 0 {
+							errorMsg("warning: %s", problem)
+						}
+						return ast.SkipChildren
+					}
+
+					return ast.GoToNext
+				})
+			}
+		}
+
+		return ast.GoToNext
+	})
+	if includeErr != nil {
+		return nil, includeErr
+	}
+
+	// Appending included nodes may have moved the nodes parents point to
+	linkParents(commands, nil)
+	return commands, nil
+}
+
+// Local markdown files being parsed, the last one is the innermost include
+var includeStack []string
+
+// parseInclude parses the file name included by the markdown file from, its
+// headings are shifted to be below level
+func parseInclude(from string, name string, level int) ([]cmdNode, error) {
+	if name == "" {
+		return nil, errors.New("include directive without a file")
+	}
+	if isRemote(from) {
+		return nil, fmt.Errorf("including '%s' is not supported in remote documents", name)
+	}
+	file := name
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(from), name)
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(includeStack, abs) {
+		return nil, fmt.Errorf("include cycle: %s", strings.Join(append(includeStack, abs), " -> "))
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("including file: %w", err)
+	}
+	includeCount++
+
+	nodes, err := parseSource(content, file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(nodes) > 0 {
+		top := nodes[0].Heading.Level
+		for _, node := range nodes {
+			top = min(top, node.Heading.Level)
+		}
+		shiftLevels(nodes, level+1-top)
+	}
+	return nodes, nil
+}
+
+// shiftLevels adds delta to the heading levels of nodes and their children
+func shiftLevels(nodes []cmdNode, delta int) {
+	for i := range nodes {
+		nodes[i].Heading.Level += delta
+		shiftLevels(nodes[i].Children, delta)
+	}
+}
+
+// splitInfo splits an info string by commas and whitespace, keeping double
+// quoted values together
+func splitInfo(info string) []string {
+	var fields []string
+	var sb strings.Builder
+	inQuotes := false
+	for _, r := range info {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && (r == ',' || r == ' ' || r == '\t'):
+			if sb.Len() > 0 {
+				fields = append(fields, sb.String())
+				sb.Reset()
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	if sb.Len() > 0 {
+		fields = append(fields, sb.String())
+	}
+	return fields
+}
+
+// parseInfo parses a code block info string such as "bash,template" or
+// "{.bash id=foo cwd=./x}" into language, flags and attributes
+func parseInfo(info string) (string, []string, map[string]string) {
+	info = strings.TrimSpace(info)
+	info = strings.TrimSuffix(strings.TrimPrefix(info, "{"), "}")
+
+	var lang string
+	var flags []string
+	attrs := make(map[string]string)
+	for i, field := range splitInfo(info) {
+		switch {
+		case i == 0 && !strings.HasPrefix(field, "#"):
+			lang = strings.TrimPrefix(field, ".")
+			// A suffix restricts the block to an OS, e.g. sh:linux
+			if name, goos, ok := strings.Cut(lang, ":"); ok {
+				lang = name
+				attrs["os"] = goos
+			}
+		case strings.HasPrefix(field, "#"):
+			attrs["id"] = field[1:]
+		case strings.Contains(field, "="):
+			key, value, _ := strings.Cut(field, "=")
+			attrs[key] = value
+		default:
+			flags = append(flags, strings.TrimPrefix(field, "."))
+		}
+	}
+	return lang, flags, attrs
+}
+
+// locateCodeBlock finds literal in source after offset, it returns the lines
+// of the opening and closing fence and the offset after the literal. The lines
+// are 0 if the literal can not be found, e.g. in indented lists.
+func locateCodeBlock(source []byte, offset int, literal []byte) (int, int, int) {
+	if len(literal) == 0 || offset > len(source) {
+		return 0, 0, offset
+	}
+	index := bytes.Index(source[offset:], literal)
+	if index < 0 {
+		return 0, 0, offset
+	}
+	start := offset + index
+	end := start + len(literal)
+	startLine := bytes.Count(source[:start], []byte("\n")) // Line before the literal
+	endLine := bytes.Count(source[:end], []byte("\n")) + 1
+	return startLine, endLine, end
+}
+
+// indentedLang returns the language of indented code blocks under cmdNode,
+// set by the "indented" env key of the heading or its parents, or by
+// --indented. Indented code blocks are ignored without a language.
+func indentedLang(cmdNode *cmdNode) string {
+	if lang, exists := inheritedEnv(cmdNode, "indented"); exists {
+		return lang
+	}
+	return options.indented
+}
+
+func newCodeBlock(v *ast.CodeBlock) codeBlock {
+	lang, flags, attrs := parseInfo(string(v.Info))
+	return codeBlock{CodeBlock: *v, Lang: lang, Flags: flags, Attrs: attrs}
+}
+
+// checkAliases reports aliases colliding with a heading on the same level
+func checkAliases(cmdNodes []cmdNode) error {
+	var siblings []cmdNode
+	var collect func(nodes []cmdNode)
+	collect = func(nodes []cmdNode) {
+		for _, node := range nodes {
+			if node.Heading.Level < options.runBaseLevel {
+				collect(node.Children)
+			} else {
+				siblings = append(siblings, node)
+			}
+		}
+	}
+	collect(cmdNodes)
+
+	for i, node := range siblings {
+		for _, alias := range nodeAliases(node) {
+			for j, sibling := range siblings {
+				if i != j && strings.EqualFold(getHeadingText(sibling.Heading), alias) {
+					return fmt.Errorf("alias '%s' of '%s' collides with heading '%s'", alias, getHeadingText(node.Heading), getHeadingText(sibling.Heading))
+				}
+			}
+		}
+		if err := checkAliases(node.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDoc reads and parses the markdown files into one command tree. Commands
+// with the same heading in different files are reported as a conflict.
+func loadDoc(files []string, timeout time.Duration) ([]cmdNode, error) {
+	docProblems = nil
+	var cmdNodes []cmdNode
+	for _, file := range files {
+		var content []byte
+		var err error
+		if isRemote(file) {
+			content, err = fetchDoc(file, timeout)
+		} else {
+			content, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading file: %w", err)
+		}
+
+		nodes, err := parseSource(content, file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		cmdNodes = append(cmdNodes, nodes...)
+	}
+
+	if len(files) > 1 {
+		if err := checkConflicts(cmdNodes); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkAliases(cmdNodes); err != nil {
+		return nil, err
+	}
+	return cmdNodes, nil
+}
+
+// parseSource builds the command tree of the markdown content of file, using
+// the cache when valid
+func parseSource(content []byte, file string) ([]cmdNode, error) {
+	matter, content, err := splitFrontmatter(content)
+	if err != nil {
+		return nil, err
+	}
+	if matter.Shell != "" && !isFlagSet("shell") {
+		if err := checkShell(matter.Shell); err != nil {
+			return nil, err
+		}
+	}
+
+	if file != "" && !isRemote(file) {
+		if abs, err := filepath.Abs(file); err == nil {
+			includeStack = append(includeStack, abs)
+			defer func() { includeStack = includeStack[:len(includeStack)-1] }()
+		}
+	}
+
+	nodes, cached := loadCache(file)
+	if !cached {
+		extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
+		p := parser.NewWithExtensions(extensions)
+		doc := p.Parse(content)
+		included := includeCount
+		nodes, err = parseDoc(doc, content, file)
+		if err != nil {
+			return nil, err
+		}
+		if includeCount == included {
+			saveCache(file, nodes)
+		}
+	}
+
+	// The frontmatter env is the root of the env chain, tables override it
+	for i := range nodes {
+		for key, value := range matter.Env {
+			if nodes[i].Env == nil {
+				nodes[i].Env = make(map[string]string)
+			}
+			if _, exists := nodes[i].Env[key]; !exists {
+				nodes[i].Env[key] = value
+			}
+		}
+	}
+	if matter.Shell != "" && !isFlagSet("shell") {
+		setDocShell(nodes, file, matter.Shell)
+	}
+	return nodes, nil
+}
+
+// setDocShell sets the frontmatter shell of the code blocks from file, code
+// blocks of included files keep their own
+func setDocShell(nodes []cmdNode, file string, shell string) {
+	for i := range nodes {
+		for j := range nodes[i].CodeBlocks {
+			if nodes[i].CodeBlocks[j].File == file {
+				nodes[i].CodeBlocks[j].DocShell = shell
+			}
+		}
+		setDocShell(nodes[i].Children, file, shell)
+	}
+}
+
+// linkParents sets the Parent of nodes and their children
+func linkParents(nodes []cmdNode, parent *cmdNode) {
+	for i := range nodes {
+		nodes[i].Parent = parent
+		linkParents(nodes[i].Children, &nodes[i])
+	}
+}
+
+// frontmatter holds the document settings of a leading YAML (---) or TOML
+// (+++) block
+type frontmatter struct {
+	Env   map[string]string `yaml:"env" toml:"env"`
+	Shell string            `yaml:"shell" toml:"shell"`
+}
+
+// splitFrontmatter parses the frontmatter of content, it returns content with
+// the frontmatter replaced by empty lines to keep the line numbers
+func splitFrontmatter(content []byte) (frontmatter, []byte, error) {
+	var matter frontmatter
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	delim := string(bytes.TrimRight(lines[0], "\r\n"))
+	if delim != "---" && delim != "+++" {
+		return matter, content, nil
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if string(bytes.TrimRight(lines[i], "\r\n")) != delim {
+			continue
+		}
+		data := bytes.Join(lines[1:i], nil)
+		var err error
+		if delim == "---" {
+			err = yaml.Unmarshal(data, &matter)
+		} else {
+			_, err = toml.Decode(string(data), &matter)
+		}
+		if err != nil {
+			return matter, content, fmt.Errorf("parsing frontmatter: %w", err)
+		}
+		return matter, append(bytes.Repeat([]byte("\n"), i+1), bytes.Join(lines[i+1:], nil)...), nil
+	}
+	return matter, content, nil
+}
+
+// fetchDoc downloads a remote markdown document
+func fetchDoc(url string, timeout time.Duration) ([]byte, error) {
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// checkConflicts reports top level commands defined in more than one file
+func checkConflicts(cmdNodes []cmdNode) error {
+	var commands []cmdNode
+	var collect func(nodes []cmdNode)
+	collect = func(nodes []cmdNode) {
+		for _, node := range nodes {
+			if node.Heading.Level < options.runBaseLevel {
+				collect(node.Children)
+			} else {
+				commands = append(commands, node)
+			}
+		}
+	}
+	collect(cmdNodes)
+
+	files := make(map[string]string)
+	for _, command := range commands {
+		heading := strings.ToLower(getHeadingText(command.Heading))
+		file := nodeFile(command)
+		if file == "" {
+			continue
+		}
+		if other, exists := files[heading]; exists && other != file {
+			return fmt.Errorf("command '%s' is defined in both %s and %s", getHeadingText(command.Heading), other, file)
+		}
+		files[heading] = file
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package mdrun
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a process group of its own, so signals can
+// reach the sub-processes of shells too
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcess sends sig to the process group of cmd, or to cmd alone when
+// it shares the process group of mdrun
+func signalProcess(cmd *exec.Cmd, sig os.Signal) error {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+	}
+	return cmd.Process.Signal(sig)
+}
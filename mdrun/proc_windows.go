@@ -0,0 +1,17 @@
+//go:build windows
+
+package mdrun
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing on windows, where console signals reach all
+// processes attached to the console
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcess stops cmd, windows can not send other signals to a process
+func signalProcess(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Kill()
+}